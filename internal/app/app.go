@@ -12,6 +12,7 @@ import (
 	"github.com/getsops/sops/v3/decrypt"
 	"github.com/joho/godotenv"
 	"github.com/pomdtr/smallweb/internal/build"
+	"github.com/pomdtr/smallweb/internal/kv"
 	"github.com/pomdtr/smallweb/internal/utils"
 	"github.com/tailscale/hujson"
 )
@@ -24,6 +25,123 @@ type AppConfig struct {
 	Entrypoint string    `json:"entrypoint,omitempty"`
 	Root       string    `json:"root,omitempty"`
 	Crons      []CronJob `json:"crons,omitempty"`
+	Limits     Limits    `json:"limits,omitzero"`
+	Requests   Requests  `json:"requests,omitzero"`
+	Static     Static    `json:"static,omitzero"`
+	// Compression encodes the responses of the app, unless disabled.
+	Compression Compression `json:"compression,omitzero"`
+	// RateLimit bounds the requests served by the app, answering the others with a 429.
+	RateLimit RateLimit `json:"rateLimit,omitzero"`
+}
+
+// Limits caps the resources used by the deno processes of an app. Zero values mean no limit.
+type Limits struct {
+	// Memory is the maximum memory in MiB, applied to the V8 heap and to the cgroup of the process.
+	Memory int `json:"memory,omitempty"`
+	// CPU is the maximum number of cores used by the process, e.g. 0.5.
+	CPU float64 `json:"cpu,omitempty"`
+	// Files is the maximum number of open file descriptors.
+	Files int `json:"files,omitempty"`
+	// Processes is the maximum number of processes and threads.
+	Processes int `json:"processes,omitempty"`
+}
+
+// Merge returns the limits, using defaults for the unset ones.
+func (me Limits) Merge(defaults Limits) Limits {
+	if me.Memory == 0 {
+		me.Memory = defaults.Memory
+	}
+
+	if me.CPU == 0 {
+		me.CPU = defaults.CPU
+	}
+
+	if me.Files == 0 {
+		me.Files = defaults.Files
+	}
+
+	if me.Processes == 0 {
+		me.Processes = defaults.Processes
+	}
+
+	return me
+}
+
+// Within returns the limits requested by an app, capped by the limits set by the admin. Unset limits
+// default to the ceilings, so that apps can only lower them.
+func (me Limits) Within(ceilings Limits) Limits {
+	me.Memory = capLimit(me.Memory, ceilings.Memory)
+	me.CPU = capLimit(me.CPU, ceilings.CPU)
+	me.Files = capLimit(me.Files, ceilings.Files)
+	me.Processes = capLimit(me.Processes, ceilings.Processes)
+
+	return me
+}
+
+func capLimit[T int | float64](value T, ceiling T) T {
+	if ceiling > 0 && (value == 0 || value > ceiling) {
+		return ceiling
+	}
+
+	return value
+}
+
+// Compression configures the encoding of the responses of an app.
+type Compression struct {
+	// Disabled sends responses as written by the app.
+	Disabled bool `json:"disabled,omitempty"`
+	// Encodings restricts the encodings used, by order of preference, among zstd, br and gzip.
+	Encodings []string `json:"encodings,omitempty"`
+	// MinSize is the size in bytes under which responses are not compressed, defaults to 1024.
+	MinSize int `json:"minSize,omitempty"`
+}
+
+// RateLimit configures the token buckets of an app, shared by all its requests and per client ip.
+type RateLimit struct {
+	App    Bucket `json:"app,omitzero"`
+	Client Bucket `json:"client,omitzero"`
+}
+
+// Bucket allows Rate requests per second on average, and up to Burst at once. Burst defaults to the rate.
+type Bucket struct {
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// Static configures how the files of apps without an entrypoint are served.
+type Static struct {
+	// SPA serves index.html for the paths which do not match a file, for client-side routing.
+	SPA bool `json:"spa,omitempty"`
+	// Listing renders the content of directories without an index.html.
+	Listing bool `json:"listing,omitempty"`
+}
+
+// Requests bounds the http requests served by an app. Zero values mean no limit, except for
+// the header timeout which defaults to 5 minutes.
+type Requests struct {
+	// Timeout is the maximum duration of a request in seconds, from reading its body to streaming the response.
+	Timeout int `json:"timeout,omitempty"`
+	// HeaderTimeout is the maximum wait for the response headers of the app, in seconds.
+	HeaderTimeout int `json:"headerTimeout,omitempty"`
+	// MaxBodySize is the maximum size of a request body in MiB.
+	MaxBodySize int `json:"maxBodySize,omitempty"`
+}
+
+// Merge returns the request limits, using defaults for the unset ones.
+func (me Requests) Merge(defaults Requests) Requests {
+	if me.Timeout == 0 {
+		me.Timeout = defaults.Timeout
+	}
+
+	if me.HeaderTimeout == 0 {
+		me.HeaderTimeout = defaults.HeaderTimeout
+	}
+
+	if me.MaxBodySize == 0 {
+		me.MaxBodySize = defaults.MaxBodySize
+	}
+
+	return me
 }
 
 type DenoConfig struct {
@@ -41,12 +159,23 @@ type App struct {
 	RootDomain string            `json:"-"`
 	Domain     string            `json:"domain,omitempty"`
 	BaseDir    string            `json:"dir,omitempty"`
+	Release    string            `json:"release,omitempty"`
 	Config     AppConfig         `json:"-"`
 	env        map[string]string `json:"-"`
+	releaseDir string
+}
+
+// SourceDir returns the dir holding the code of the app, which is the served release for deployed apps.
+func (me *App) SourceDir() string {
+	if me.releaseDir != "" {
+		return me.releaseDir
+	}
+
+	return me.BaseDir
 }
 
 func (me *App) Dir() string {
-	dir := me.BaseDir
+	dir := me.SourceDir()
 
 	if me.Config.Root != "" {
 		return filepath.Join(dir, me.Config.Root)
@@ -112,6 +241,19 @@ func LoadApp(appname string, rootDir string, rootDomain string) (App, error) {
 		env:        make(map[string]string),
 	}
 
+	// the served release is resolved once, so that the app is not affected by later deploys
+	codeDir := appDir
+	release, err := CurrentRelease(appDir)
+	if err != nil {
+		return App{}, fmt.Errorf("could not read current release: %v", err)
+	}
+
+	if release != "" {
+		app.Release = release
+		app.releaseDir = filepath.Join(appDir, ReleasesDirName, release)
+		codeDir = app.releaseDir
+	}
+
 	if dotenvPath := filepath.Join(appDir, ".env"); utils.FileExists(dotenvPath) {
 		dotenv, err := godotenv.Read(dotenvPath)
 		if err != nil {
@@ -124,8 +266,8 @@ func LoadApp(appname string, rootDir string, rootDomain string) (App, error) {
 	}
 
 	for _, secretPath := range []string{
-		filepath.Join(appDir, "secrets.enc.env"),
-		filepath.Join(appDir, "secrets.env"),
+		filepath.Join(codeDir, "secrets.enc.env"),
+		filepath.Join(codeDir, "secrets.env"),
 	} {
 		if !utils.FileExists(secretPath) {
 			continue
@@ -153,6 +295,18 @@ func LoadApp(appname string, rootDir string, rootDomain string) (App, error) {
 		break
 	}
 
+	config, err := LoadConfig(codeDir)
+	if err != nil {
+		return App{}, err
+	}
+	app.Config = config
+
+	return app, nil
+}
+
+// LoadConfig reads the smallweb.json(c) file of an app directory, if any.
+func LoadConfig(appDir string) (AppConfig, error) {
+	var config AppConfig
 	for _, configName := range []string{"smallweb.json", "smallweb.jsonc"} {
 		configPath := filepath.Join(appDir, configName)
 		if !utils.FileExists(configPath) {
@@ -161,22 +315,22 @@ func LoadApp(appname string, rootDir string, rootDomain string) (App, error) {
 
 		rawBytes, err := os.ReadFile(configPath)
 		if err != nil {
-			return App{}, fmt.Errorf("could not read %s: %v", configName, err)
+			return AppConfig{}, fmt.Errorf("could not read %s: %v", configName, err)
 		}
 
 		configBytes, err := hujson.Standardize(rawBytes)
 		if err != nil {
-			return App{}, fmt.Errorf("could not standardize %s: %v", configName, err)
+			return AppConfig{}, fmt.Errorf("could not standardize %s: %v", configName, err)
 		}
 
-		if err := json.Unmarshal(configBytes, &app.Config); err != nil {
-			return App{}, fmt.Errorf("could not unmarshal %s: %v", configName, err)
+		if err := json.Unmarshal(configBytes, &config); err != nil {
+			return AppConfig{}, fmt.Errorf("could not unmarshal %s: %v", configName, err)
 		}
 
-		return app, nil
+		return config, nil
 	}
 
-	return app, nil
+	return config, nil
 }
 
 func (me App) Entrypoint() string {
@@ -199,7 +353,27 @@ func (me App) Entrypoint() string {
 		}
 	}
 
-	return "jsr:@smallweb/file-server@0.8.2"
+	return fileServerEntrypoint
+}
+
+// fileServerEntrypoint serves the files of apps without an entrypoint. Smallweb serves
+// them natively over http, deno is only used for their commands.
+const fileServerEntrypoint = "jsr:@smallweb/file-server@0.8.2"
+
+// IsStatic reports whether the app only serves files.
+func (me App) IsStatic() bool {
+	return me.Entrypoint() == fileServerEntrypoint
+}
+
+// DatabasePath returns the path of the SQLite database managed by smallweb for the app.
+// The database is created on first use.
+func (me App) DatabasePath() string {
+	return filepath.Join(me.BaseDir, "data", "smallweb.db")
+}
+
+// KVPath returns the path of the database backing the key-value store of the app.
+func (me App) KVPath() string {
+	return filepath.Join(me.BaseDir, "data", "smallweb-kv.db")
 }
 
 func (me App) Env() []string {
@@ -215,6 +389,8 @@ func (me App) Env() []string {
 	env = append(env, fmt.Sprintf("SMALLWEB_VERSION=%s", build.Version))
 	env = append(env, fmt.Sprintf("SMALLWEB_DIR=%s", me.RootDir))
 	env = append(env, fmt.Sprintf("SMALLWEB_DOMAIN=%s", me.RootDomain))
+	env = append(env, fmt.Sprintf("SMALLWEB_DB_PATH=%s", me.DatabasePath()))
+	env = append(env, kv.Env(me.Name)...)
 
 	// open telemetry
 	for _, value := range os.Environ() {
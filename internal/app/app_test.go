@@ -0,0 +1,26 @@
+package app
+
+import "testing"
+
+func TestLimitsWithin(t *testing.T) {
+	ceilings := Limits{Memory: 512, CPU: 1, Files: 1024}
+
+	for name, tc := range map[string]struct {
+		requested Limits
+		expected  Limits
+	}{
+		"unset":  {Limits{}, Limits{Memory: 512, CPU: 1, Files: 1024}},
+		"lower":  {Limits{Memory: 128, CPU: 0.5}, Limits{Memory: 128, CPU: 0.5, Files: 1024}},
+		"higher": {Limits{Memory: 4096, CPU: 8, Files: 1 << 20}, Limits{Memory: 512, CPU: 1, Files: 1024}},
+		"no cap": {Limits{Processes: 64}, Limits{Memory: 512, CPU: 1, Files: 1024, Processes: 64}},
+		"mixed":  {Limits{Memory: 1024, Files: 10}, Limits{Memory: 512, CPU: 1, Files: 10}},
+	} {
+		if limits := tc.requested.Within(ceilings); limits != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", name, tc.expected, limits)
+		}
+	}
+
+	if limits := (Limits{Memory: 4096}).Within(Limits{}); limits != (Limits{Memory: 4096}) {
+		t.Errorf("expected the requested limits without ceilings, got %+v", limits)
+	}
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deployed apps keep their releases in <app>/.releases/<id>, and serve the one
+// targeted by the <app>/.current symlink. Runtime state (data dir, .env) stays in the app dir.
+const (
+	ReleasesDirName = ".releases"
+	CurrentLinkName = ".current"
+)
+
+var ErrReleaseNotFound = errors.New("release not found")
+
+// Releases returns the release ids of an app, oldest first.
+func Releases(appDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(appDir, ReleasesDirName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var releases []string
+	for _, entry := range entries {
+		// staging dirs are hidden
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		releases = append(releases, entry.Name())
+	}
+
+	slices.SortFunc(releases, compareReleases)
+	return releases, nil
+}
+
+// compareReleases orders release ids by creation. Ids are a timestamp with a second precision,
+// followed by a counter for the releases created in the same second, e.g. 20250101120000-2,
+// so the counters are compared as numbers: 20250101120000-10 comes after 20250101120000-9.
+func compareReleases(a, b string) int {
+	timestampA, suffixA, _ := strings.Cut(a, "-")
+	timestampB, suffixB, _ := strings.Cut(b, "-")
+	if c := strings.Compare(timestampA, timestampB); c != 0 {
+		return c
+	}
+
+	counterA, errA := strconv.Atoi(suffixA)
+	counterB, errB := strconv.Atoi(suffixB)
+	if suffixA == "" || suffixB == "" || errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+
+	return cmp.Compare(counterA, counterB)
+}
+
+// CurrentRelease returns the id of the release served by an app, or an empty string if it has none.
+func CurrentRelease(appDir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(appDir, CurrentLinkName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return filepath.Base(target), nil
+}
+
+// CreateRelease populates a new release of an app. The release is only visible once populate succeeds,
+// and is not served until it is activated.
+func CreateRelease(appDir string, populate func(dir string) error) (string, error) {
+	releasesDir := filepath.Join(appDir, ReleasesDirName)
+	if err := os.MkdirAll(releasesDir, 0755); err != nil {
+		return "", err
+	}
+
+	releases, err := Releases(appDir)
+	if err != nil {
+		return "", err
+	}
+
+	timestamp := time.Now().UTC().Format("20060102150405")
+	id := timestamp
+	for suffix := 1; slices.Contains(releases, id); suffix++ {
+		id = fmt.Sprintf("%s-%d", timestamp, suffix)
+	}
+
+	stagingDir, err := os.MkdirTemp(releasesDir, "."+id+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if err := os.Chmod(stagingDir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := populate(stagingDir); err != nil {
+		return "", err
+	}
+
+	// the data dir is shared between releases
+	if _, err := os.Lstat(filepath.Join(stagingDir, "data")); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Join(appDir, "data"), 0755); err != nil {
+			return "", err
+		}
+
+		if err := os.Symlink(filepath.Join("..", "..", "data"), filepath.Join(stagingDir, "data")); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Rename(stagingDir, filepath.Join(releasesDir, id)); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// ActivateRelease atomically points the app to one of its releases.
+func ActivateRelease(appDir string, id string) error {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return ErrReleaseNotFound
+	}
+
+	if _, err := os.Stat(filepath.Join(appDir, ReleasesDirName, id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrReleaseNotFound
+		}
+
+		return err
+	}
+
+	tmpLink := filepath.Join(appDir, fmt.Sprintf("%s-%d", CurrentLinkName, time.Now().UnixNano()))
+	if err := os.Symlink(filepath.Join(ReleasesDirName, id), tmpLink); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpLink, filepath.Join(appDir, CurrentLinkName)); err != nil {
+		os.Remove(tmpLink)
+		return err
+	}
+
+	return nil
+}
+
+// PruneReleases removes the oldest releases of an app, keeping the current one.
+func PruneReleases(appDir string, keep int) error {
+	releases, err := Releases(appDir)
+	if err != nil {
+		return err
+	}
+
+	current, err := CurrentRelease(appDir)
+	if err != nil {
+		return err
+	}
+
+	if len(releases) <= keep {
+		return nil
+	}
+
+	var errs []error
+	for _, id := range releases[:len(releases)-keep] {
+		if id == current {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(appDir, ReleasesDirName, id)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
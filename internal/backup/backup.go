@@ -0,0 +1,300 @@
+// Package backup snapshots the data dirs of apps to local or remote storages.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pomdtr/smallweb/internal/archive"
+	"github.com/pomdtr/smallweb/internal/database"
+)
+
+// Snapshot ids are their creation time, with a nanosecond precision so that snapshots created
+// in the same second do not overwrite each other. Snapshots created by older versions have no fraction.
+const (
+	timeFormat       = "20060102T150405.000000000Z"
+	legacyTimeFormat = "20060102T150405Z"
+)
+
+// parseID returns the creation time of a snapshot from its id.
+func parseID(id string) (time.Time, error) {
+	if t, err := time.Parse(timeFormat, id); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(legacyTimeFormat, id)
+}
+
+// Snapshot is an archive of the data dir of an app.
+type Snapshot struct {
+	App      string    `json:"app"`
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+	Storages []string  `json:"storages"`
+}
+
+func snapshotKey(appname string, id string) string {
+	return path.Join(appname, id+".tar.gz")
+}
+
+// Create archives the data dir of an app, and uploads it to every storage.
+func Create(ctx context.Context, storages []Storage, appname string, dataDir string) (Snapshot, error) {
+	f, err := os.CreateTemp("", fmt.Sprintf("smallweb-backup-%s-*.tar.gz", appname))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	if err := addDataDir(ctx, tw, dataDir); err != nil {
+		return Snapshot{}, fmt.Errorf("could not archive %s: %w", dataDir, err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return Snapshot{}, err
+	}
+
+	if err := gw.Close(); err != nil {
+		return Snapshot{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	now := time.Now().UTC()
+	snapshot := Snapshot{
+		App:  appname,
+		ID:   now.Format(timeFormat),
+		Time: now,
+		Size: info.Size(),
+	}
+
+	var errs []error
+	for _, storage := range storages {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return Snapshot{}, err
+		}
+
+		if err := storage.Put(ctx, snapshotKey(appname, snapshot.ID), f); err != nil {
+			errs = append(errs, fmt.Errorf("could not upload snapshot to %s storage: %w", storage.Name(), err))
+			continue
+		}
+
+		snapshot.Storages = append(snapshot.Storages, storage.Name())
+	}
+
+	return snapshot, errors.Join(errs...)
+}
+
+// addDataDir archives a data dir. SQLite databases are copied through sqlite, so that they
+// are consistent even if apps keep writing to them.
+func addDataDir(ctx context.Context, tw *tar.Writer, dataDir string) error {
+	var databases []string
+	if err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() || !database.IsDatabase(path) {
+			return nil
+		}
+
+		name, err := filepath.Rel(dataDir, path)
+		if err != nil {
+			return err
+		}
+
+		databases = append(databases, name)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := archive.AddDir(tw, dataDir, func(name string) bool {
+		for _, db := range databases {
+			if name == db || name == db+"-wal" || name == db+"-shm" || name == db+"-journal" {
+				return true
+			}
+		}
+
+		return false
+	}); err != nil {
+		return err
+	}
+
+	if len(databases) == 0 {
+		return nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "smallweb-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i, name := range databases {
+		copyPath := filepath.Join(tmpDir, fmt.Sprintf("%d.db", i))
+		if err := database.Snapshot(ctx, filepath.Join(dataDir, name), copyPath); err != nil {
+			return err
+		}
+
+		if err := archive.AddFile(tw, name, copyPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns the snapshots of an app found in any storage, oldest first.
+func List(ctx context.Context, storages []Storage, appname string) ([]Snapshot, error) {
+	snapshots := make(map[string]*Snapshot)
+	for _, storage := range storages {
+		objects, err := storage.List(ctx, appname+"/")
+		if err != nil {
+			return nil, fmt.Errorf("could not list %s storage: %w", storage.Name(), err)
+		}
+
+		for _, object := range objects {
+			id, ok := strings.CutSuffix(path.Base(object.Key), ".tar.gz")
+			if !ok || path.Dir(object.Key) != appname {
+				continue
+			}
+
+			t, err := parseID(id)
+			if err != nil {
+				continue
+			}
+
+			if snapshot, ok := snapshots[id]; ok {
+				snapshot.Storages = append(snapshot.Storages, storage.Name())
+				continue
+			}
+
+			snapshots[id] = &Snapshot{
+				App:      appname,
+				ID:       id,
+				Time:     t,
+				Size:     object.Size,
+				Storages: []string{storage.Name()},
+			}
+		}
+	}
+
+	var result []Snapshot
+	for _, snapshot := range snapshots {
+		result = append(result, *snapshot)
+	}
+
+	slices.SortFunc(result, func(a, b Snapshot) int {
+		if c := a.Time.Compare(b.Time); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return result, nil
+}
+
+// PreviousDataDir returns where Restore keeps the data dir it replaced. The dir is hidden,
+// so that it is not served with the files of static apps.
+func PreviousDataDir(dataDir string) string {
+	return filepath.Join(filepath.Dir(dataDir), "."+filepath.Base(dataDir)+"-previous")
+}
+
+// Restore replaces the data dir of an app with one of its snapshots, read from the first storage holding it.
+// The replaced data dir is moved to PreviousDataDir, replacing the one kept by a previous restore, so that
+// it can be moved back if the app does not work with the snapshot. It is up to the caller to remove it.
+func Restore(ctx context.Context, storages []Storage, appname string, id string, dataDir string) error {
+	if _, err := parseID(id); err != nil {
+		return ErrNotFound
+	}
+
+	var r io.ReadCloser
+	for _, storage := range storages {
+		var err error
+		r, err = storage.Get(ctx, snapshotKey(appname, id))
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("could not read snapshot from %s storage: %w", storage.Name(), err)
+		}
+	}
+
+	if r == nil {
+		return ErrNotFound
+	}
+	defer r.Close()
+
+	// the snapshot is extracted next to the data dir, so that it can be moved in place at once
+	parentDir := filepath.Dir(dataDir)
+	stagingDir, err := os.MkdirTemp(parentDir, ".data-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if err := os.Chmod(stagingDir, 0755); err != nil {
+		return err
+	}
+
+	if err := archive.Extract(r, stagingDir); err != nil {
+		return fmt.Errorf("could not extract snapshot: %w", err)
+	}
+
+	if _, err := os.Stat(dataDir); err == nil {
+		previousDir := PreviousDataDir(dataDir)
+		if err := os.RemoveAll(previousDir); err != nil {
+			return err
+		}
+
+		if err := os.Rename(dataDir, previousDir); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(stagingDir, dataDir)
+}
+
+// Prune removes the oldest snapshots of an app from every storage, keeping the most recent ones.
+func Prune(ctx context.Context, storages []Storage, appname string, keep int) error {
+	var errs []error
+	for _, storage := range storages {
+		snapshots, err := List(ctx, []Storage{storage}, appname)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if len(snapshots) <= keep {
+			continue
+		}
+
+		for _, snapshot := range snapshots[:len(snapshots)-keep] {
+			if err := storage.Delete(ctx, snapshotKey(appname, snapshot.ID)); err != nil {
+				errs = append(errs, fmt.Errorf("could not delete snapshot %s from %s storage: %w", snapshot.ID, storage.Name(), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,336 @@
+package backup
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// s3Server is an in-memory stand-in for the S3 api, handling the path-style requests of the sdk.
+type s3Server struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newS3Server(t *testing.T, bucket string) (*s3Server, *S3Storage) {
+	t.Helper()
+
+	// the sdk must not look for credentials outside of the test
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	server := &s3Server{bucket: bucket, objects: make(map[string][]byte)}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	storage, err := NewS3Storage(context.Background(), S3Config{
+		Bucket:          bucket,
+		Prefix:          "smallweb",
+		Endpoint:        ts.URL,
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, storage
+}
+
+func (me *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != me.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		me.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+
+		me.objects[key] = body
+	case r.Method == http.MethodGet:
+		body, ok := me.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body)
+	case r.Method == http.MethodDelete:
+		delete(me.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (me *s3Server) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string
+		Size int
+	}
+
+	result := struct {
+		XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: me.bucket, Prefix: prefix}
+
+	for key, body := range me.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: len(body)})
+		}
+	}
+
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// readBody reads the body of a put request, decoding the aws-chunked encoding used by the sdk
+// to send checksums as trailers.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return body, nil
+	}
+
+	var decoded []byte
+	for {
+		line, rest, ok := strings.Cut(string(body), "\r\n")
+		if !ok {
+			return nil, errors.New("invalid chunk")
+		}
+
+		var size int
+		if _, err := fmt.Sscanf(strings.Split(line, ";")[0], "%x", &size); err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return decoded, nil
+		}
+
+		decoded = append(decoded, rest[:size]...)
+		body = []byte(strings.TrimPrefix(rest[size:], "\r\n"))
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// newDataDir creates the data dir of an app, holding a single file.
+func newDataDir(t *testing.T, content string) string {
+	t.Helper()
+
+	dataDir := filepath.Join(t.TempDir(), "app", "data")
+	if err := os.MkdirAll(filepath.Join(dataDir, "nested"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeData(t, dataDir, content)
+	return dataDir
+}
+
+func writeData(t *testing.T, dataDir string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dataDir, "nested", "file.txt"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readData(t *testing.T, dataDir string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(dataDir, "nested", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestCreateListRestore(t *testing.T) {
+	ctx := context.Background()
+	server, s3Storage := newS3Server(t, "backups")
+	storages := []Storage{NewLocalStorage(t.TempDir()), s3Storage}
+
+	dataDir := newDataDir(t, "v1")
+	first, err := Create(ctx, storages, "blog", dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(first.Storages, []string{"local", "s3"}) {
+		t.Fatalf("expected the snapshot to be stored locally and on s3, got %v", first.Storages)
+	}
+
+	if _, ok := server.objects["smallweb/blog/"+first.ID+".tar.gz"]; !ok {
+		t.Fatalf("snapshot not uploaded under the prefix: %v", server.objects)
+	}
+
+	writeData(t, dataDir, "v2")
+	second, err := Create(ctx, storages, "blog", dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.ID == second.ID {
+		t.Fatalf("snapshots created in a row share the id %s", first.ID)
+	}
+
+	snapshots, err := List(ctx, storages, "blog")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 2 || snapshots[0].ID != first.ID || snapshots[1].ID != second.ID {
+		t.Fatalf("expected the two snapshots, oldest first, got %+v", snapshots)
+	}
+
+	for _, snapshot := range snapshots {
+		if !slices.Equal(snapshot.Storages, []string{"local", "s3"}) {
+			t.Errorf("expected snapshot %s in both storages, got %v", snapshot.ID, snapshot.Storages)
+		}
+	}
+
+	writeData(t, dataDir, "v3")
+	if err := Restore(ctx, storages, "blog", first.ID, dataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readData(t, dataDir); content != "v1" {
+		t.Fatalf("expected the first snapshot to be restored, got %q", content)
+	}
+
+	// the replaced data is kept until the caller drops it
+	if content := readData(t, PreviousDataDir(dataDir)); content != "v3" {
+		t.Fatalf("expected the replaced data to be kept, got %q", content)
+	}
+
+	if err := Restore(ctx, storages, "blog", "20060102T150405.000000000Z", dataDir); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an unknown snapshot, got %v", err)
+	}
+
+	if err := Restore(ctx, storages, "blog", "../other", dataDir); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an invalid id, got %v", err)
+	}
+}
+
+func TestRestoreFromS3(t *testing.T) {
+	ctx := context.Background()
+	_, s3Storage := newS3Server(t, "backups")
+
+	dataDir := newDataDir(t, "remote")
+	snapshot, err := Create(ctx, []Storage{s3Storage}, "blog", dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. restoring on a new server, whose local storage is empty
+	storages := []Storage{NewLocalStorage(t.TempDir()), s3Storage}
+	newDataDir := filepath.Join(t.TempDir(), "data")
+	if err := Restore(ctx, storages, "blog", snapshot.ID, newDataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readData(t, newDataDir); content != "remote" {
+		t.Fatalf("expected the snapshot to be restored from s3, got %q", content)
+	}
+
+	if _, err := os.Stat(PreviousDataDir(newDataDir)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no previous data dir, got %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	server, s3Storage := newS3Server(t, "backups")
+	storages := []Storage{NewLocalStorage(t.TempDir()), s3Storage}
+
+	dataDir := newDataDir(t, "data")
+	var ids []string
+	for range 4 {
+		snapshot, err := Create(ctx, storages, "blog", dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, snapshot.ID)
+	}
+
+	// snapshots of other apps are left untouched
+	if _, err := Create(ctx, storages, "blog-old", dataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Prune(ctx, storages, "blog", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, storage := range storages {
+		snapshots, err := List(ctx, []Storage{storage}, "blog")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var kept []string
+		for _, snapshot := range snapshots {
+			kept = append(kept, snapshot.ID)
+		}
+
+		if !slices.Equal(kept, ids[2:]) {
+			t.Errorf("expected %s storage to keep the two most recent snapshots %v, got %v", storage.Name(), ids[2:], kept)
+		}
+
+		others, err := List(ctx, []Storage{storage}, "blog-old")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(others) != 1 {
+			t.Errorf("expected the snapshot of another app to be kept in %s storage, got %v", storage.Name(), others)
+		}
+	}
+
+	if len(server.objects) != 3 {
+		t.Fatalf("expected 3 objects left in the bucket, got %d", len(server.objects))
+	}
+}
@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Config configures an S3-compatible backup destination.
+// Credentials are read from the environment when they are not set.
+type S3Config struct {
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix,omitempty"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+}
+
+// S3Storage stores backups in an S3 bucket.
+type S3Storage struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Storage(ctx context.Context, conf S3Config) (*S3Storage, error) {
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if conf.Region != "" {
+		opts = append(opts, config.WithRegion(conf.Region))
+	} else if conf.Endpoint != "" {
+		// most S3-compatible services ignore the region, but the sdk requires one
+		opts = append(opts, config.WithRegion("auto"))
+	}
+
+	if conf.AccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(conf.AccessKeyID, conf.SecretAccessKey, "")))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load s3 config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if conf.Endpoint != "" {
+			o.BaseEndpoint = aws.String(conf.Endpoint)
+			o.UsePathStyle = true
+			// S3-compatible services often skip response checksums
+			o.DisableLogOutputChecksumValidationSkipped = true
+		}
+	})
+
+	return &S3Storage{
+		client: client,
+		bucket: conf.Bucket,
+		prefix: strings.Trim(conf.Prefix, "/"),
+	}, nil
+}
+
+func (me *S3Storage) Name() string {
+	return "s3"
+}
+
+func (me *S3Storage) key(key string) string {
+	if me.prefix == "" {
+		return key
+	}
+
+	return path.Join(me.prefix, key)
+}
+
+func (me *S3Storage) Put(ctx context.Context, key string, r io.ReadSeeker) error {
+	_, err := me.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(me.bucket),
+		Key:    aws.String(me.key(key)),
+		Body:   r,
+	})
+
+	return err
+}
+
+func (me *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	output, err := me.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(me.bucket),
+		Key:    aws.String(me.key(key)),
+	})
+	if err != nil {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return output.Body, nil
+}
+
+func (me *S3Storage) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	paginator := s3.NewListObjectsV2Paginator(me.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(me.bucket),
+		Prefix: aws.String(me.key(prefix)),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if me.prefix != "" {
+				key = strings.TrimPrefix(key, me.prefix+"/")
+			}
+
+			objects = append(objects, Object{Key: key, Size: aws.ToInt64(object.Size)})
+		}
+	}
+
+	return objects, nil
+}
+
+func (me *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := me.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(me.bucket),
+		Key:    aws.String(me.key(key)),
+	})
+
+	return err
+}
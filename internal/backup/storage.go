@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotFound = errors.New("snapshot not found")
+
+// Object is a file stored in a backup destination.
+type Object struct {
+	Key  string
+	Size int64
+}
+
+// Storage is a backup destination. Keys are slash separated paths.
+type Storage interface {
+	Name() string
+	Put(ctx context.Context, key string, r io.ReadSeeker) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalStorage stores backups in a directory.
+type LocalStorage struct {
+	Dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Dir: dir}
+}
+
+func (me *LocalStorage) Name() string {
+	return "local"
+}
+
+func (me *LocalStorage) Put(ctx context.Context, key string, r io.ReadSeeker) error {
+	p := filepath.Join(me.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that partial snapshots are never listed
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+func (me *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(me.Dir, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+func (me *LocalStorage) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(filepath.Join(me.Dir, filepath.FromSlash(path.Dir(prefix))), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(me.Dir, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, Object{Key: key, Size: info.Size()})
+		return nil
+	})
+
+	return objects, err
+}
+
+func (me *LocalStorage) Delete(ctx context.Context, key string) error {
+	return os.Remove(filepath.Join(me.Dir, filepath.FromSlash(key)))
+}
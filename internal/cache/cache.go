@@ -0,0 +1,457 @@
+// Package cache stores the responses of apps following their Cache-Control headers, so that
+// cacheable requests are answered without waking up their worker.
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// MaxEntrySize is the size above which response bodies are not stored.
+const MaxEntrySize = 16 << 20
+
+// Options configures a Cache.
+type Options struct {
+	// Dir holds the bodies spilled from memory, and the purge markers.
+	Dir string
+	// MaxMemory and MaxDisk are the number of bytes of bodies kept in memory and on disk.
+	MaxMemory int64
+	MaxDisk   int64
+	// ModTime returns the last modification of an app. Responses stored before are stale.
+	ModTime func(app string) time.Time
+}
+
+// Cache is a shared http cache, keeping the most recently used responses in memory and
+// spilling the others to disk.
+type Cache struct {
+	dir       string
+	maxMemory int64
+	maxDisk   int64
+	modTime   func(app string) time.Time
+	watcher   *fsnotify.Watcher
+
+	mu      sync.Mutex
+	entries map[string][]*entry
+	lru     *list.List
+	memory  int64
+	disk    int64
+	// purges are the paths purged from the cache for each app, with the time they were purged
+	purges map[string]map[string]time.Time
+}
+
+type entry struct {
+	key     string
+	variant string
+	status  int
+	header  http.Header
+	body    []byte
+	file    string
+	size    int64
+	// date is when the response was generated, storedAt when it was stored or last revalidated
+	date      time.Time
+	storedAt  time.Time
+	expiresAt time.Time
+	elem      *list.Element
+}
+
+// New creates a cache, dropping the responses spilled to disk by previous servers.
+func New(opts Options) (*Cache, error) {
+	if err := os.RemoveAll(opts.Dir); err != nil {
+		return nil, fmt.Errorf("failed to clear cache dir: %w", err)
+	}
+
+	for _, dir := range []string{"bodies", "purges"} {
+		if err := os.MkdirAll(filepath.Join(opts.Dir, dir), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache dir: %w", err)
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch purges: %w", err)
+	}
+
+	if err := watcher.Add(filepath.Join(opts.Dir, "purges")); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch purges: %w", err)
+	}
+
+	modTime := opts.ModTime
+	if modTime == nil {
+		modTime = func(string) time.Time { return time.Time{} }
+	}
+
+	me := &Cache{
+		dir:       opts.Dir,
+		maxMemory: opts.MaxMemory,
+		maxDisk:   opts.MaxDisk,
+		modTime:   modTime,
+		watcher:   watcher,
+		entries:   make(map[string][]*entry),
+		lru:       list.New(),
+		purges:    make(map[string]map[string]time.Time),
+	}
+
+	go me.watchPurges()
+	return me, nil
+}
+
+// Close stops loading the purges written by the cli.
+func (me *Cache) Close() error {
+	return me.watcher.Close()
+}
+
+// hit is a copy of an entry, which stays valid after the entry is evicted.
+type hit struct {
+	entry     *entry
+	status    int
+	header    http.Header
+	body      io.ReadCloser
+	date      time.Time
+	expiresAt time.Time
+}
+
+func (me *hit) age(now time.Time) time.Duration {
+	return max(now.Sub(me.date), 0)
+}
+
+// Serve answers a request of an app from the cache, or forwards it to next and stores the response.
+func (me *Cache) Serve(w http.ResponseWriter, r *http.Request, app string, next http.Handler) {
+	key := app + " " + r.Host + r.URL.RequestURI()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// unsafe methods are likely to change the resource
+		me.invalidate(key)
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if reqCC.has("no-store") || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	now := time.Now()
+	h := me.lookup(app, key, r)
+	if h != nil {
+		defer h.body.Close()
+
+		fresh := now.Before(h.expiresAt) && !reqCC.has("no-cache")
+		if maxAge, ok := reqCC.seconds("max-age"); ok && h.age(now) > maxAge {
+			fresh = false
+		}
+
+		if fresh {
+			serveHit(w, r, h, "hit")
+			return
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	rec := &recorder{
+		ResponseWriter: w,
+		request:        r,
+		header:         make(http.Header),
+		status:         "fwd=miss",
+	}
+
+	req := r
+	if h != nil {
+		rec.status = "fwd=stale"
+		if !hasConditionals(r) && (h.header.Get("ETag") != "" || h.header.Get("Last-Modified") != "") {
+			req = r.Clone(r.Context())
+			if etag := h.header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified := h.header.Get("Last-Modified"); lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+
+			rec.intercept = true
+		}
+	}
+
+	next.ServeHTTP(rec, req)
+	if rec.intercepted {
+		me.refresh(r, h, rec.header)
+		serveHit(w, r, h, "fwd=stale; fwd-status=304")
+		return
+	}
+
+	if rec.body != nil {
+		me.store(app, key, r, rec.code, rec.ttl, rec.header, rec.body.Bytes())
+	}
+}
+
+func hasConditionals(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+func serveHit(w http.ResponseWriter, r *http.Request, h *hit, status string) {
+	header := w.Header()
+	for name, values := range h.header {
+		header[name] = values
+	}
+
+	header.Set("Age", strconv.Itoa(int(h.age(time.Now()).Seconds())))
+	header.Set("Cache-Status", "smallweb; "+status)
+
+	if etag := h.header.Get("ETag"); etag != "" && matchesETag(r.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(h.status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, _ = io.Copy(w, h.body)
+}
+
+// matchesETag uses the weak comparison of If-None-Match.
+func matchesETag(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (me *Cache) lookup(app string, key string, r *http.Request) *hit {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	entries := me.entries[key]
+	if len(entries) == 0 {
+		return nil
+	}
+
+	purgedAt := me.purgedAt(app, r.URL.Path)
+	for _, e := range entries {
+		if !e.storedAt.After(purgedAt) {
+			me.remove(e)
+			continue
+		}
+
+		if e.variant != varyKey(e.header, r) {
+			continue
+		}
+
+		var body io.ReadCloser
+		if e.file != "" {
+			f, err := os.Open(e.file)
+			if err != nil {
+				me.remove(e)
+				return nil
+			}
+
+			body = f
+		} else {
+			body = io.NopCloser(bytes.NewReader(e.body))
+		}
+
+		me.lru.MoveToFront(e.elem)
+		return &hit{
+			entry:     e,
+			status:    e.status,
+			header:    e.header.Clone(),
+			body:      body,
+			date:      e.date,
+			expiresAt: e.expiresAt,
+		}
+	}
+
+	return nil
+}
+
+// refresh updates a stale entry with the headers of a 304 response.
+func (me *Cache) refresh(r *http.Request, h *hit, header http.Header) {
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+
+		h.header[name] = values
+	}
+
+	now := time.Now()
+	ttl, ok := lifetime(r, h.status, h.header)
+	h.date = responseDate(now, h.header)
+	h.expiresAt = now.Add(ttl)
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	e := h.entry
+	if e.elem == nil {
+		return
+	}
+
+	if !ok {
+		me.remove(e)
+		return
+	}
+
+	e.header = h.header.Clone()
+	e.date = h.date
+	e.storedAt = now
+	e.expiresAt = h.expiresAt
+}
+
+func (me *Cache) store(app string, key string, r *http.Request, status int, ttl time.Duration, header http.Header, body []byte) {
+	if contentLength := header.Get("Content-Length"); contentLength != "" && contentLength != strconv.Itoa(len(body)) {
+		// the response was interrupted
+		return
+	}
+
+	header = header.Clone()
+	header.Del("Age")
+	header.Del("Cache-Status")
+
+	now := time.Now()
+	e := &entry{
+		key:       key,
+		variant:   varyKey(header, r),
+		status:    status,
+		header:    header,
+		body:      body,
+		size:      int64(len(body)),
+		date:      responseDate(now, header),
+		storedAt:  now,
+		expiresAt: now.Add(ttl),
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	// the app may have been purged while the response was generated
+	if !now.After(me.purgedAt(app, r.URL.Path)) {
+		return
+	}
+
+	for _, existing := range me.entries[key] {
+		if existing.variant == e.variant {
+			me.remove(existing)
+		}
+	}
+
+	e.elem = me.lru.PushFront(e)
+	me.entries[key] = append(me.entries[key], e)
+	me.memory += e.size
+	me.evict()
+}
+
+// responseDate estimates when a response was generated, from its Age header.
+func responseDate(now time.Time, header http.Header) time.Time {
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		return now.Add(-time.Duration(age) * time.Second)
+	}
+
+	return now
+}
+
+func (me *Cache) invalidate(key string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	for _, e := range me.entries[key] {
+		me.remove(e)
+	}
+}
+
+func (me *Cache) remove(e *entry) {
+	if e.elem == nil {
+		return
+	}
+
+	me.lru.Remove(e.elem)
+	e.elem = nil
+
+	entries := me.entries[e.key]
+	for i, existing := range entries {
+		if existing == e {
+			entries = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+
+	if len(entries) == 0 {
+		delete(me.entries, e.key)
+	} else {
+		me.entries[e.key] = entries
+	}
+
+	if e.file != "" {
+		// readers keep their open file
+		_ = os.Remove(e.file)
+		me.disk -= e.size
+	} else {
+		me.memory -= e.size
+	}
+}
+
+// evict spills the least recently used bodies to disk until they fit in memory, then drops
+// the least recently used spilled entries until they fit on disk.
+func (me *Cache) evict() {
+	for elem := me.lru.Back(); elem != nil && me.memory > me.maxMemory; {
+		e := elem.Value.(*entry)
+		elem = elem.Prev()
+		if e.file != "" {
+			continue
+		}
+
+		if e.size > me.maxDisk || me.spill(e) != nil {
+			me.remove(e)
+		}
+	}
+
+	for elem := me.lru.Back(); elem != nil && me.disk > me.maxDisk; {
+		e := elem.Value.(*entry)
+		elem = elem.Prev()
+		if e.file != "" {
+			me.remove(e)
+		}
+	}
+}
+
+func (me *Cache) spill(e *entry) error {
+	sum := sha256.Sum256([]byte(e.key + "\n" + e.variant + "\n" + e.storedAt.String()))
+	file := filepath.Join(me.dir, "bodies", hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(file, e.body, 0o600); err != nil {
+		return err
+	}
+
+	e.file = file
+	e.body = nil
+	me.memory -= e.size
+	me.disk += e.size
+	return nil
+}
@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream stands for the worker of an app, counting the requests reaching it.
+type upstream struct {
+	calls   atomic.Int32
+	handler http.HandlerFunc
+}
+
+func (me *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.calls.Add(1)
+	me.handler(w, r)
+}
+
+// respond returns an upstream answering each request with a body counting the calls.
+func respond(header map[string]string) *upstream {
+	u := &upstream{}
+	u.handler = func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range header {
+			w.Header().Set(name, value)
+		}
+
+		fmt.Fprintf(w, "response %d", u.calls.Load())
+	}
+
+	return u
+}
+
+func newTestCache(t *testing.T, opts Options) *Cache {
+	t.Helper()
+
+	opts.Dir = filepath.Join(t.TempDir(), "cache")
+	if opts.MaxMemory == 0 {
+		opts.MaxMemory = 1 << 20
+	}
+	if opts.MaxDisk == 0 {
+		opts.MaxDisk = 1 << 20
+	}
+
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func fetch(c *Cache, next http.Handler, method string, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	c.Serve(w, r, "blog", next)
+	return w
+}
+
+func expectBody(t *testing.T, w *httptest.ResponseRecorder, body string, status string) {
+	t.Helper()
+
+	if w.Body.String() != body {
+		t.Errorf("expected %q, got %q", body, w.Body.String())
+	}
+
+	if cacheStatus := w.Header().Get("Cache-Status"); cacheStatus != "smallweb; "+status {
+		t.Errorf("expected cache status %q, got %q", status, cacheStatus)
+	}
+}
+
+func TestFreshResponses(t *testing.T) {
+	c := newTestCache(t, Options{})
+	u := respond(map[string]string{"Cache-Control": "max-age=60"})
+
+	expectBody(t, fetch(c, u, http.MethodGet, "/posts"), "response 1", "fwd=miss")
+	expectBody(t, fetch(c, u, http.MethodGet, "/posts"), "response 1", "hit")
+
+	w := fetch(c, u, http.MethodHead, "/posts")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || u.calls.Load() != 1 {
+		t.Errorf("expected head requests to be answered from the cache, got %d after %d calls", w.Code, u.calls.Load())
+	}
+
+	// the key includes the query
+	expectBody(t, fetch(c, u, http.MethodGet, "/posts?page=2"), "response 2", "fwd=miss")
+
+	// clients may require a response younger than the stored one
+	expectBody(t, fetch(c, u, http.MethodGet, "/posts", "Cache-Control", "no-cache"), "response 3", "fwd=stale")
+	expectBody(t, fetch(c, u, http.MethodGet, "/posts"), "response 3", "hit")
+
+	if calls := u.calls.Load(); calls != 3 {
+		t.Fatalf("expected 3 requests to reach the app, got %d", calls)
+	}
+}
+
+func TestUncacheableResponses(t *testing.T) {
+	for name, header := range map[string]map[string]string{
+		"no-store":     {"Cache-Control": "no-store, max-age=60"},
+		"private":      {"Cache-Control": "private, max-age=60"},
+		"cookie":       {"Cache-Control": "max-age=60", "Set-Cookie": "session=1"},
+		"vary star":    {"Cache-Control": "max-age=60", "Vary": "*"},
+		"event stream": {"Cache-Control": "max-age=60", "Content-Type": "text/event-stream"},
+		"no freshness": {},
+		"expired":      {"Expires": "0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newTestCache(t, Options{})
+			u := respond(header)
+
+			expectBody(t, fetch(c, u, http.MethodGet, "/"), "response 1", "fwd=miss")
+			expectBody(t, fetch(c, u, http.MethodGet, "/"), "response 2", "fwd=miss")
+		})
+	}
+
+	t.Run("authorization", func(t *testing.T) {
+		c := newTestCache(t, Options{})
+		u := respond(map[string]string{"Cache-Control": "max-age=60"})
+
+		expectBody(t, fetch(c, u, http.MethodGet, "/", "Authorization", "Bearer token"), "response 1", "fwd=miss")
+		expectBody(t, fetch(c, u, http.MethodGet, "/"), "response 2", "fwd=miss")
+	})
+
+	t.Run("error status", func(t *testing.T) {
+		c := newTestCache(t, Options{})
+		u := &upstream{handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}}
+
+		fetch(c, u, http.MethodGet, "/")
+		fetch(c, u, http.MethodGet, "/")
+		if calls := u.calls.Load(); calls != 2 {
+			t.Fatalf("expected errors to reach the app each time, got %d calls", calls)
+		}
+	})
+}
+
+func TestLifetime(t *testing.T) {
+	now := time.Now()
+	for name, tc := range map[string]struct {
+		header map[string]string
+		ttl    time.Duration
+		ok     bool
+	}{
+		"max-age":          {map[string]string{"Cache-Control": "max-age=60"}, time.Minute, true},
+		"s-maxage":         {map[string]string{"Cache-Control": "max-age=60, s-maxage=120"}, 2 * time.Minute, true},
+		"age":              {map[string]string{"Cache-Control": "max-age=60", "Age": "20"}, 40 * time.Second, true},
+		"expires":          {map[string]string{"Expires": now.Add(time.Hour).UTC().Format(http.TimeFormat), "Date": now.UTC().Format(http.TimeFormat)}, time.Hour, true},
+		"no-cache etag":    {map[string]string{"Cache-Control": "no-cache", "ETag": `"v1"`}, 0, true},
+		"no-cache":         {map[string]string{"Cache-Control": "no-cache"}, 0, false},
+		"stale with etag":  {map[string]string{"Cache-Control": "max-age=0", "ETag": `"v1"`}, 0, true},
+		"invalid max-age":  {map[string]string{"Cache-Control": "max-age=soon"}, 0, false},
+		"upper case":       {map[string]string{"Cache-Control": "Max-Age=60"}, time.Minute, true},
+		"quoted directive": {map[string]string{"Cache-Control": `max-age="60"`}, time.Minute, true},
+	} {
+		header := make(http.Header)
+		for name, value := range tc.header {
+			header.Set(name, value)
+		}
+
+		ttl, ok := lifetime(httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, header)
+		if ok != tc.ok || (ttl-tc.ttl).Abs() > time.Second {
+			t.Errorf("%s: expected %s, %v, got %s, %v", name, tc.ttl, tc.ok, ttl, ok)
+		}
+	}
+}
+
+func TestVary(t *testing.T) {
+	c := newTestCache(t, Options{})
+	u := &upstream{}
+	u.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "%s %d", r.Header.Get("Accept-Language"), u.calls.Load())
+	}
+
+	expectBody(t, fetch(c, u, http.MethodGet, "/", "Accept-Language", "en"), "en 1", "fwd=miss")
+	expectBody(t, fetch(c, u, http.MethodGet, "/", "Accept-Language", "fr"), "fr 2", "fwd=miss")
+	expectBody(t, fetch(c, u, http.MethodGet, "/", "Accept-Language", "en"), "en 1", "hit")
+	expectBody(t, fetch(c, u, http.MethodGet, "/", "Accept-Language", "fr"), "fr 2", "hit")
+	expectBody(t, fetch(c, u, http.MethodGet, "/"), " 3", "fwd=miss")
+}
+
+func TestRevalidation(t *testing.T) {
+	c := newTestCache(t, Options{})
+	u := &upstream{}
+	u.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("X-Revalidated", "true")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		fmt.Fprint(w, "content")
+	}
+
+	expectBody(t, fetch(c, u, http.MethodGet, "/"), "content", "fwd=miss")
+
+	w := fetch(c, u, http.MethodGet, "/")
+	expectBody(t, w, "content", "fwd=stale; fwd-status=304")
+	if w.Code != http.StatusOK || w.Header().Get("X-Revalidated") != "true" {
+		t.Errorf("expected the stored response with the headers of the 304, got %d, %v", w.Code, w.Header())
+	}
+
+	// conditional requests of clients are forwarded as is
+	w = fetch(c, u, http.MethodGet, "/", "If-None-Match", `"v1"`)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected the 304 of the app, got %d: %q", w.Code, w.Body.String())
+	}
+
+	if calls := u.calls.Load(); calls != 3 {
+		t.Fatalf("expected each request to be revalidated, got %d calls", calls)
+	}
+}
+
+func TestConditionalHits(t *testing.T) {
+	c := newTestCache(t, Options{})
+	u := respond(map[string]string{"Cache-Control": "max-age=60", "ETag": `"v1"`})
+
+	fetch(c, u, http.MethodGet, "/")
+	w := fetch(c, u, http.MethodGet, "/", "If-None-Match", `W/"v0", W/"v1"`)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected a 304 from the cache, got %d: %q", w.Code, w.Body.String())
+	}
+
+	if calls := u.calls.Load(); calls != 1 {
+		t.Fatalf("expected the hit not to reach the app, got %d calls", calls)
+	}
+}
+
+func TestUnsafeMethodsInvalidate(t *testing.T) {
+	c := newTestCache(t, Options{})
+	u := respond(map[string]string{"Cache-Control": "max-age=60"})
+
+	fetch(c, u, http.MethodGet, "/posts")
+	fetch(c, u, http.MethodPost, "/posts")
+	expectBody(t, fetch(c, u, http.MethodGet, "/posts"), "response 3", "fwd=miss")
+}
+
+func TestSpillToDisk(t *testing.T) {
+	// a single body fits in memory
+	c := newTestCache(t, Options{MaxMemory: 12, MaxDisk: 1 << 20})
+	u := respond(map[string]string{"Cache-Control": "max-age=60"})
+
+	for _, target := range []string{"/a", "/b", "/c"} {
+		fetch(c, u, http.MethodGet, target)
+	}
+
+	for i, target := range []string{"/a", "/b", "/c"} {
+		expectBody(t, fetch(c, u, http.MethodGet, target), fmt.Sprintf("response %d", i+1), "hit")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.memory > 12 || c.disk == 0 {
+		t.Fatalf("expected bodies to be spilled to disk, got %d bytes in memory and %d on disk", c.memory, c.disk)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var modTime atomic.Int64
+	c := newTestCache(t, Options{ModTime: func(app string) time.Time { return time.Unix(0, modTime.Load()) }})
+	u := respond(map[string]string{"Cache-Control": "max-age=60"})
+
+	for _, target := range []string{"/posts/1", "/posts", "/postscript", "/about"} {
+		fetch(c, u, http.MethodGet, target)
+	}
+
+	if err := Purge(c.dir, "blog", "posts/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the purges are loaded by the watcher
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		loaded := len(c.purges["blog"]) > 0
+		c.mu.Unlock()
+
+		if loaded {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("purges were not loaded")
+		}
+	}
+
+	for target, status := range map[string]string{
+		"/posts/1":    "fwd=miss",
+		"/posts":      "fwd=miss",
+		"/postscript": "hit",
+		"/about":      "hit",
+	} {
+		w := fetch(c, u, http.MethodGet, target)
+		if cacheStatus := w.Header().Get("Cache-Status"); !strings.HasSuffix(cacheStatus, status) {
+			t.Errorf("%s: expected %s, got %s", target, status, cacheStatus)
+		}
+	}
+
+	// changes to the app drop all its responses
+	modTime.Store(time.Now().UnixNano())
+	expected := fmt.Sprintf("response %d", u.calls.Load()+1)
+	expectBody(t, fetch(c, u, http.MethodGet, "/about"), expected, "fwd=miss")
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives are the parsed values of Cache-Control headers. Directives without value map to "".
+type directives map[string]string
+
+func parseCacheControl(values []string) directives {
+	d := make(directives)
+	for _, value := range values {
+		for part := range strings.SplitSeq(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+
+			d[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+
+	return d
+}
+
+func (me directives) has(name string) bool {
+	_, ok := me[name]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive.
+func (me directives) seconds(name string) (time.Duration, bool) {
+	value, ok := me[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus lists the status codes which are cacheable by default, from RFC 9110.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// lifetime returns how long a response stays fresh, and whether it may be stored at all.
+// Only explicit freshness is honored: responses without max-age or Expires are stored
+// if they have a validator, and revalidated on each request.
+func lifetime(r *http.Request, status int, header http.Header) (time.Duration, bool) {
+	if !cacheableStatus[status] {
+		return 0, false
+	}
+
+	cc := parseCacheControl(header.Values("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") {
+		return 0, false
+	}
+
+	// responses setting cookies are specific to a client
+	if header.Get("Set-Cookie") != "" || header.Get("Trailer") != "" {
+		return 0, false
+	}
+
+	if vary := header.Get("Vary"); strings.TrimSpace(vary) == "*" {
+		return 0, false
+	}
+
+	// streams never complete
+	if strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return 0, false
+	}
+
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return 0, false
+	}
+
+	hasValidator := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	if cc.has("no-cache") {
+		return 0, hasValidator
+	}
+
+	var ttl time.Duration
+	if maxAge, ok := cc.seconds("s-maxage"); ok {
+		ttl = maxAge
+	} else if maxAge, ok := cc.seconds("max-age"); ok {
+		ttl = maxAge
+	} else if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid dates, e.g. 0, mean already expired
+			return 0, hasValidator
+		}
+
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+
+		ttl = expiresAt.Sub(date)
+	}
+
+	// the response may have been served from a cache of the app itself
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		ttl -= time.Duration(age) * time.Second
+	}
+
+	if ttl <= 0 {
+		return 0, hasValidator
+	}
+
+	return ttl, true
+}
+
+// varyKey returns the values of the request headers selecting a variant of the response.
+func varyKey(header http.Header, r *http.Request) string {
+	var sb strings.Builder
+	for _, value := range header.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			sb.WriteString(name)
+			sb.WriteString(":")
+			sb.WriteString(strings.Join(r.Header.Values(name), ","))
+			sb.WriteString("\n")
+		}
+	}
+
+	return sb.String()
+}
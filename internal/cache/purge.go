@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Purges are stored on disk, so that the cache of a running server can be purged from the cli.
+// The server loads them when the files change, and looks them up from memory.
+
+func purgePath(dir string, app string) string {
+	return filepath.Join(dir, "purges", app+".json")
+}
+
+// Purge drops the responses of an app stored before now, for the given path and the paths below it.
+func Purge(dir string, app string, path string) error {
+	path = "/" + strings.Trim(path, "/")
+
+	paths, err := readPurges(purgePath(dir, app))
+	if err != nil {
+		return err
+	}
+
+	paths[path] = time.Now()
+	content, err := json.Marshal(paths)
+	if err != nil {
+		return fmt.Errorf("failed to encode purges: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "purges"), 0o755); err != nil {
+		return fmt.Errorf("failed to create purges dir: %w", err)
+	}
+
+	// the server may read the file at any time
+	tmp := purgePath(dir, app) + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write purges: %w", err)
+	}
+
+	if err := os.Rename(tmp, purgePath(dir, app)); err != nil {
+		return fmt.Errorf("failed to write purges: %w", err)
+	}
+
+	return nil
+}
+
+func readPurges(path string) (map[string]time.Time, error) {
+	paths := make(map[string]time.Time)
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return paths, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read purges: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &paths); err != nil {
+		return nil, fmt.Errorf("failed to decode purges: %w", err)
+	}
+
+	return paths, nil
+}
+
+// watchPurges loads the purges of an app each time its file is written.
+func (me *Cache) watchPurges() {
+	for {
+		select {
+		case event, ok := <-me.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+
+			app, ok := strings.CutSuffix(filepath.Base(event.Name), ".json")
+			if !ok {
+				continue
+			}
+
+			// the file is replaced at once, a partial write is followed by another event
+			paths, err := readPurges(event.Name)
+			if err != nil {
+				continue
+			}
+
+			me.mu.Lock()
+			me.purges[app] = paths
+			me.mu.Unlock()
+		case _, ok := <-me.watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// purgedAt returns the last time the responses of a path were invalidated, either by a
+// purge or by a change to the app. It must be called with the lock held.
+func (me *Cache) purgedAt(app string, urlPath string) time.Time {
+	purgedAt := me.modTime(app)
+	for path, t := range me.purges[app] {
+		if path == "/" || urlPath == path || strings.HasPrefix(urlPath, path+"/") {
+			purgedAt = later(purgedAt, t)
+		}
+	}
+
+	return purgedAt
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+
+	return a
+}
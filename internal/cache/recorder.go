@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// recorder forwards a response to the client while keeping a copy of cacheable bodies.
+type recorder struct {
+	http.ResponseWriter
+	request *http.Request
+	// header is written to the client with the status, so that 304 responses to conditional
+	// requests sent by the cache can be intercepted
+	header      http.Header
+	status      string
+	wroteHeader bool
+	code        int
+	ttl         time.Duration
+	body        *bytes.Buffer
+
+	intercept   bool
+	intercepted bool
+}
+
+func (me *recorder) Header() http.Header {
+	if me.wroteHeader && !me.intercepted {
+		// trailers are announced once the body is written
+		return me.ResponseWriter.Header()
+	}
+
+	return me.header
+}
+
+func (me *recorder) WriteHeader(code int) {
+	if me.wroteHeader {
+		return
+	}
+
+	if code == http.StatusNotModified && me.intercept {
+		me.wroteHeader = true
+		me.intercepted = true
+		return
+	}
+
+	header := me.ResponseWriter.Header()
+	for name, values := range me.header {
+		header[name] = values
+	}
+
+	// informational responses precede the final one
+	if code >= 100 && code < 200 {
+		me.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	me.wroteHeader = true
+	me.code = code
+	header.Set("Cache-Status", "smallweb; "+me.status)
+
+	if ttl, ok := lifetime(me.request, code, me.header); ok {
+		contentLength, err := strconv.Atoi(me.header.Get("Content-Length"))
+		if err != nil || contentLength <= MaxEntrySize {
+			me.ttl = ttl
+			me.body = &bytes.Buffer{}
+		}
+	}
+
+	me.ResponseWriter.WriteHeader(code)
+}
+
+func (me *recorder) Write(p []byte) (int, error) {
+	if !me.wroteHeader {
+		me.WriteHeader(http.StatusOK)
+	}
+
+	if me.intercepted {
+		return len(p), nil
+	}
+
+	if me.body != nil {
+		if me.body.Len()+len(p) > MaxEntrySize {
+			me.body = nil
+		} else {
+			me.body.Write(p)
+		}
+	}
+
+	return me.ResponseWriter.Write(p)
+}
+
+func (me *recorder) Flush() {
+	if me.intercepted {
+		return
+	}
+
+	_ = http.NewResponseController(me.ResponseWriter).Flush()
+}
+
+func (me *recorder) Unwrap() http.ResponseWriter {
+	return me.ResponseWriter
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/archive"
+	"github.com/pomdtr/smallweb/internal/utils"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+)
+
+var secretFiles = []string{".env", "secrets.env", "secrets.enc.env"}
+
+func NewCmdExport() *cobra.Command {
+	var flags struct {
+		output             string
+		excludeData        bool
+		excludeNodeModules bool
+		excludeSecrets     bool
+	}
+
+	cmd := &cobra.Command{
+		Use:               "export <app>",
+		Short:             "Export an app as a tar.gz archive",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeApp,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := app.LoadApp(args[0], k.String("dir"), k.String("domain"))
+			if err != nil {
+				cmd.PrintErrf("failed to load app %s: %v\n", args[0], err)
+				return ExitError{1}
+			}
+
+			output := flags.output
+			if isRemote(cmd) {
+				if output != "" && output != "-" {
+					cmd.PrintErrln("over ssh, the archive can only be written to stdout, e.g. ssh smallweb.run export blog > blog.tar.gz")
+					return ExitError{1}
+				}
+
+				output = "-"
+			} else if output == "" {
+				output = fmt.Sprintf("%s.tar.gz", a.Name)
+			}
+
+			var w io.Writer = cmd.OutOrStdout()
+			if output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					cmd.PrintErrf("failed to create %s: %v\n", output, err)
+					return ExitError{1}
+				}
+				defer f.Close()
+
+				w = f
+			}
+
+			skip := func(name string) bool {
+				switch {
+				case name == ".git", name == app.ReleasesDirName, name == app.CurrentLinkName:
+					return true
+				case name == "data":
+					return flags.excludeData
+				case filepath.Base(name) == "node_modules":
+					return flags.excludeNodeModules
+				case slices.Contains(secretFiles, name):
+					return flags.excludeSecrets
+				}
+
+				return false
+			}
+
+			if err := exportApp(a, w, skip); err != nil {
+				if output != "-" {
+					os.Remove(output)
+				}
+
+				cmd.PrintErrf("failed to export %s: %v\n", a.Name, err)
+				return ExitError{1}
+			}
+
+			if output != "-" {
+				cmd.PrintErrf("Exported %s to %s\n", a.Name, output)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&flags.output, "output", "o", "", "output file, use - for stdout (default <app>.tar.gz, stdout over ssh)")
+	cmd.Flags().BoolVar(&flags.excludeData, "exclude-data", false, "exclude the data dir")
+	cmd.Flags().BoolVar(&flags.excludeNodeModules, "exclude-node-modules", false, "exclude node_modules dirs")
+	cmd.Flags().BoolVar(&flags.excludeSecrets, "exclude-secrets", false, "exclude .env and secrets files")
+
+	return cmd
+}
+
+// exportApp writes the files of an app as a tar.gz archive. For deployed apps, the served
+// release is exported alongside the runtime state of the app.
+func exportApp(a app.App, w io.Writer, skip func(name string) bool) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	if a.SourceDir() == a.BaseDir {
+		if err := archive.AddDir(tw, a.BaseDir, skip); err != nil {
+			return err
+		}
+	} else {
+		// releases link to the data dir of the app
+		if err := archive.AddDir(tw, a.SourceDir(), func(name string) bool {
+			return name == "data" || skip(name)
+		}); err != nil {
+			return err
+		}
+
+		for _, name := range []string{"data", ".env"} {
+			if skip(name) || !utils.FileExists(filepath.Join(a.BaseDir, name)) {
+				continue
+			}
+
+			if err := archive.AddDir(tw, a.BaseDir, func(path string) bool {
+				return path != name && !strings.HasPrefix(path, name+string(filepath.Separator)) || skip(path)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+func NewCmdImport() *cobra.Command {
+	var flags struct {
+		force bool
+	}
+
+	cmd := &cobra.Command{
+		Use:   "import <archive> [name]",
+		Short: "Import an app from a tar.gz archive",
+		Long: `Import an app from a tar.gz archive, as created by smallweb export.
+
+Use - to read the archive from stdin, e.g. smallweb export blog -o - | ssh smallweb.run import - blog`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			archivePath := args[0]
+			if isRemote(cmd) && archivePath != "-" {
+				cmd.PrintErrln("over ssh, the archive can only be read from stdin, e.g. ssh smallweb.run import - blog < blog.tar.gz")
+				return ExitError{1}
+			}
+
+			var appname string
+			if len(args) > 1 {
+				appname = args[1]
+			} else if archivePath != "-" {
+				appname = strings.TrimSuffix(strings.TrimSuffix(filepath.Base(archivePath), ".tgz"), ".tar.gz")
+			} else {
+				cmd.PrintErrln("the app name is required when reading the archive from stdin")
+				return ExitError{1}
+			}
+
+			if !appNameRegexp.MatchString(appname) {
+				cmd.PrintErrf("invalid app name %s, only lowercase letters, digits and hyphens are allowed\n", appname)
+				return ExitError{1}
+			}
+
+			appDir := filepath.Join(k.String("dir"), appname)
+			if utils.FileExists(appDir) && !flags.force {
+				cmd.PrintErrf("app %s already exists, use --force to replace it\n", appname)
+				return ExitError{1}
+			}
+
+			var r io.Reader = cmd.InOrStdin()
+			if archivePath != "-" {
+				f, err := os.Open(archivePath)
+				if err != nil {
+					cmd.PrintErrf("failed to open archive: %v\n", err)
+					return ExitError{1}
+				}
+				defer f.Close()
+
+				r = f
+			}
+
+			// the archive is extracted next to the app dir, so that it can be moved in place at once
+			stagingDir, err := os.MkdirTemp(k.String("dir"), fmt.Sprintf(".%s-", appname))
+			if err != nil {
+				cmd.PrintErrf("failed to create staging dir: %v\n", err)
+				return ExitError{1}
+			}
+			defer os.RemoveAll(stagingDir)
+
+			if err := os.Chmod(stagingDir, 0755); err != nil {
+				cmd.PrintErrf("failed to create staging dir: %v\n", err)
+				return ExitError{1}
+			}
+
+			if err := archive.Extract(r, stagingDir); err != nil {
+				cmd.PrintErrf("failed to extract archive: %v\n", err)
+				return ExitError{1}
+			}
+
+			if err := validateApp(stagingDir); err != nil {
+				cmd.PrintErrf("invalid app: %v\n", err)
+				return ExitError{1}
+			}
+
+			if utils.FileExists(appDir) {
+				if err := os.RemoveAll(appDir); err != nil {
+					cmd.PrintErrf("failed to remove existing app: %v\n", err)
+					return ExitError{1}
+				}
+			}
+
+			if err := os.Rename(stagingDir, appDir); err != nil {
+				cmd.PrintErrf("failed to import app: %v\n", err)
+				return ExitError{1}
+			}
+
+			cmd.PrintErrf("Imported %s to https://%s.%s/\n", appname, appname, k.String("domain"))
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&flags.force, "force", false, "replace the app if it already exists")
+
+	return cmd
+}
+
+// validateApp checks that the config of an extracted app can be loaded and refers to existing files.
+func validateApp(dir string) error {
+	config, err := app.LoadConfig(dir)
+	if err != nil {
+		return err
+	}
+
+	if config.Root != "" {
+		if info, err := os.Stat(filepath.Join(dir, config.Root)); err != nil || !info.IsDir() {
+			return fmt.Errorf("root dir %s not found", config.Root)
+		}
+	}
+
+	isRemote := strings.HasPrefix(config.Entrypoint, "jsr:") || strings.HasPrefix(config.Entrypoint, "npm:") || strings.HasPrefix(config.Entrypoint, "https://") || strings.HasPrefix(config.Entrypoint, "http://")
+	if config.Entrypoint != "" && !isRemote && !utils.FileExists(filepath.Join(dir, config.Root, config.Entrypoint)) {
+		return fmt.Errorf("entrypoint %s not found", config.Entrypoint)
+	}
+
+	parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+	for _, job := range config.Crons {
+		if job.Name == "" {
+			return fmt.Errorf("cron job with schedule %s has no name", job.Schedule)
+		}
+
+		if _, err := parser.Parse(job.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule for cron job %s: %v", job.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cli/go-gh/v2/pkg/tableprinter"
+	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/backup"
+	"github.com/pomdtr/smallweb/internal/utils"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+)
+
+// backupStorages returns the destinations configured for backups. Snapshots are always kept
+// locally, and also uploaded to an S3-compatible bucket when backup.s3.bucket is set.
+func backupStorages(ctx context.Context) ([]backup.Storage, error) {
+	dir := filepath.Join(k.String("dir"), ".smallweb", "backups")
+	if k.String("backup.dir") != "" {
+		dir = k.String("backup.dir")
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(k.String("dir"), dir)
+		}
+	}
+
+	storages := []backup.Storage{backup.NewLocalStorage(dir)}
+	if k.String("backup.s3.bucket") == "" {
+		return storages, nil
+	}
+
+	s3Storage, err := backup.NewS3Storage(ctx, backup.S3Config{
+		Bucket:          k.String("backup.s3.bucket"),
+		Prefix:          k.String("backup.s3.prefix"),
+		Endpoint:        k.String("backup.s3.endpoint"),
+		Region:          k.String("backup.s3.region"),
+		AccessKeyID:     k.String("backup.s3.accessKeyId"),
+		SecretAccessKey: k.String("backup.s3.secretAccessKey"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(storages, s3Storage), nil
+}
+
+// keepBackups returns the number of snapshots kept for each app.
+func keepBackups() int {
+	if k.Exists("backup.keep") {
+		return max(k.Int("backup.keep"), 1)
+	}
+
+	return 7
+}
+
+var errNoDataDir = errors.New("app has no data dir")
+
+// backupApp snapshots the data dir of an app, then prunes its oldest snapshots.
+func backupApp(ctx context.Context, storages []backup.Storage, a app.App) (backup.Snapshot, error) {
+	dataDir := filepath.Join(a.BaseDir, "data")
+	if !utils.FileExists(dataDir) {
+		return backup.Snapshot{}, errNoDataDir
+	}
+
+	snapshot, err := backup.Create(ctx, storages, a.Name, dataDir)
+	if err != nil {
+		return snapshot, err
+	}
+
+	return snapshot, backup.Prune(ctx, storages, a.Name, keepBackups())
+}
+
+// BackupRunner snapshots the data dir of every app on the schedule set in backup.schedule.
+func BackupRunner(schedule string, logger *slog.Logger) (*cron.Cron, error) {
+	parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+	c := cron.New(cron.WithParser(parser))
+	if _, err := c.AddFunc(schedule, func() {
+		storages, err := backupStorages(context.Background())
+		if err != nil {
+			logger.Error("failed to configure backup storages", "error", err)
+			return
+		}
+
+		apps, err := app.LookupApps(k.String("dir"))
+		if err != nil {
+			logger.Error("failed to list apps", "error", err)
+			return
+		}
+
+		for _, appname := range apps {
+			a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
+			if err != nil {
+				logger.Error("failed to load app", "app", appname, "error", err)
+				continue
+			}
+
+			snapshot, err := backupApp(context.Background(), storages, a)
+			if errors.Is(err, errNoDataDir) {
+				continue
+			}
+
+			if err != nil {
+				logger.Error("failed to back up app", "app", appname, "error", err)
+				continue
+			}
+
+			logger.Info("backed up app", "app", appname, "snapshot", snapshot.ID, "size", snapshot.Size, "storages", snapshot.Storages)
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("invalid backup schedule: %w", err)
+	}
+
+	return c, nil
+}
+
+func NewCmdBackup() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Manage snapshots of app data dirs",
+	}
+
+	cmd.AddCommand(NewCmdBackupCreate())
+	cmd.AddCommand(NewCmdBackupList())
+	cmd.AddCommand(NewCmdBackupRestore())
+
+	return cmd
+}
+
+func NewCmdBackupCreate() *cobra.Command {
+	var flags struct {
+		all bool
+	}
+
+	cmd := &cobra.Command{
+		Use:               "create [app...]",
+		Short:             "Snapshot the data dir of apps",
+		ValidArgsFunction: completeApp,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && !flags.all {
+				cmd.PrintErrln("specify the apps to back up, or use --all")
+				return ExitError{1}
+			}
+
+			if flags.all {
+				apps, err := app.LookupApps(k.String("dir"))
+				if err != nil {
+					cmd.PrintErrf("failed to list apps: %v\n", err)
+					return ExitError{1}
+				}
+
+				args = apps
+			}
+
+			storages, err := backupStorages(cmd.Context())
+			if err != nil {
+				cmd.PrintErrf("failed to configure backup storages: %v\n", err)
+				return ExitError{1}
+			}
+
+			var failed bool
+			for _, appname := range args {
+				a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
+				if err != nil {
+					cmd.PrintErrf("failed to load app %s: %v\n", appname, err)
+					failed = true
+					continue
+				}
+
+				snapshot, err := backupApp(cmd.Context(), storages, a)
+				if err != nil {
+					cmd.PrintErrf("failed to back up %s: %v\n", appname, err)
+					failed = true
+					continue
+				}
+
+				cmd.PrintErrf("Created snapshot %s of %s (%d bytes)\n", snapshot.ID, appname, snapshot.Size)
+			}
+
+			if failed {
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&flags.all, "all", false, "back up all apps")
+
+	return cmd
+}
+
+func NewCmdBackupList() *cobra.Command {
+	var flags struct {
+		json bool
+	}
+
+	cmd := &cobra.Command{
+		Use:               "list <app>",
+		Short:             "List the snapshots of an app",
+		Aliases:           []string{"ls"},
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeApp,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storages, err := backupStorages(cmd.Context())
+			if err != nil {
+				cmd.PrintErrf("failed to configure backup storages: %v\n", err)
+				return ExitError{1}
+			}
+
+			snapshots, err := backup.List(cmd.Context(), storages, args[0])
+			if err != nil {
+				cmd.PrintErrf("failed to list snapshots: %v\n", err)
+				return ExitError{1}
+			}
+
+			if flags.json {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetEscapeHTML(false)
+				if isTerminal(cmd.OutOrStdout()) {
+					encoder.SetIndent("", "  ")
+				}
+
+				if snapshots == nil {
+					snapshots = []backup.Snapshot{}
+				}
+
+				if err := encoder.Encode(snapshots); err != nil {
+					cmd.PrintErrf("failed to encode snapshots as json: %v\n", err)
+					return ExitError{1}
+				}
+
+				return nil
+			}
+
+			if len(snapshots) == 0 {
+				cmd.Println("No snapshots found")
+				return nil
+			}
+
+			var printer tableprinter.TablePrinter
+			if isTerminal(cmd.OutOrStdout()) {
+				width, err := terminalWidth(cmd.OutOrStdout())
+				if err != nil {
+					return fmt.Errorf("failed to get terminal size: %w", err)
+				}
+
+				printer = tableprinter.New(cmd.OutOrStdout(), true, width)
+			} else {
+				printer = tableprinter.New(cmd.OutOrStdout(), false, 0)
+			}
+
+			printer.AddHeader([]string{"Snapshot", "Created", "Size", "Storages"})
+			for _, snapshot := range snapshots {
+				printer.AddField(snapshot.ID)
+				printer.AddField(snapshot.Time.Local().Format(time.DateTime))
+				printer.AddField(fmt.Sprint(snapshot.Size))
+				printer.AddField(strings.Join(snapshot.Storages, ", "))
+
+				printer.EndRow()
+			}
+
+			return printer.Render()
+		},
+	}
+
+	cmd.Flags().BoolVar(&flags.json, "json", false, "output as json")
+
+	return cmd
+}
+
+func NewCmdBackupRestore() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <app> <snapshot>",
+		Short: "Replace the data dir of an app with a snapshot",
+		Long: `Replace the data dir of an app with a snapshot.
+
+The replaced data dir is kept in .data-previous, until the app is started with the snapshot when
+restoring over ssh, or until the next restore otherwise.`,
+		Args: cobra.ExactArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return completeApp(cmd, args, toComplete)
+			}
+
+			if len(args) > 1 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			storages, err := backupStorages(cmd.Context())
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			snapshots, err := backup.List(cmd.Context(), storages, args[0])
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			var ids []string
+			for _, snapshot := range snapshots {
+				ids = append(ids, snapshot.ID)
+			}
+
+			return ids, cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveKeepOrder
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := app.LoadApp(args[0], k.String("dir"), k.String("domain"))
+			if err != nil {
+				cmd.PrintErrf("failed to load app %s: %v\n", args[0], err)
+				return ExitError{1}
+			}
+
+			storages, err := backupStorages(cmd.Context())
+			if err != nil {
+				cmd.PrintErrf("failed to configure backup storages: %v\n", err)
+				return ExitError{1}
+			}
+
+			// the watcher restarts the worker once the data dir is swapped
+			dataDir := filepath.Join(a.BaseDir, "data")
+			if err := backup.Restore(cmd.Context(), storages, a.Name, args[1], dataDir); err != nil {
+				if errors.Is(err, backup.ErrNotFound) {
+					cmd.PrintErrf("snapshot %s not found for %s\n", args[1], a.Name)
+					return ExitError{1}
+				}
+
+				cmd.PrintErrf("failed to restore snapshot %s: %v\n", args[1], err)
+				return ExitError{1}
+			}
+
+			cmd.PrintErrf("Restored %s from snapshot %s\n", a.Name, args[1])
+			previousDir := backup.PreviousDataDir(dataDir)
+			if !utils.FileExists(previousDir) {
+				return nil
+			}
+
+			// within the server, the previous data is dropped once the app is up with the snapshot
+			if handler, ok := handlerFromContext(cmd.Context()); ok && !a.IsStatic() {
+				if err := handler.RestartWorker(a.Name); err != nil {
+					cmd.PrintErrf("failed to start %s with the snapshot, the previous data dir was kept in %s: %v\n", a.Name, previousDir, err)
+					return ExitError{1}
+				}
+
+				if err := os.RemoveAll(previousDir); err != nil {
+					cmd.PrintErrf("failed to remove the previous data dir: %v\n", err)
+				}
+
+				return nil
+			}
+
+			cmd.PrintErrf("The previous data dir was kept in %s, remove it once the app works\n", previousDir)
+			return nil
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/cache"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdCache() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the response cache",
+		Long: `Manage the http cache of the evaluation server.
+
+When cache.enabled is set in the global config, the responses of apps are stored according to their
+Cache-Control headers, and served without waking up their worker until they expire.`,
+	}
+
+	cmd.AddCommand(NewCmdCachePurge())
+
+	return cmd
+}
+
+func NewCmdCachePurge() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "purge <app> [path]",
+		Short: "Drop the cached responses of an app",
+		Long:  "Drop the cached responses of an app, or only those of a path and the paths below it.",
+		Args:  cobra.RangeArgs(1, 2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return completeApp(cmd, args, toComplete)
+			}
+
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := app.LoadApp(args[0], k.String("dir"), k.String("domain")); err != nil {
+				cmd.PrintErrf("failed to load app: %v\n", err)
+				return ExitError{1}
+			}
+
+			path := "/"
+			if len(args) > 1 {
+				path = args[1]
+			}
+
+			if err := cache.Purge(cacheDir(), args[0], path); err != nil {
+				cmd.PrintErrf("failed to purge cache: %v\n", err)
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func cacheDir() string {
+	return filepath.Join(k.String("dir"), ".smallweb", "cache")
+}
+
+// cacheSize returns the budget of the response cache in bytes, read from a size in MiB.
+func cacheSize(key string, fallback int) int64 {
+	size := fallback
+	if k.Exists(key) {
+		size = max(k.Int(key), 0)
+	}
+
+	return int64(size) << 20
+}
@@ -8,7 +8,6 @@ import (
 	"os/exec"
 	"path/filepath"
 
-	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 	"github.com/tailscale/hujson"
 )
@@ -30,11 +29,12 @@ func NewCmdConfig() *cobra.Command {
 	}
 
 	cmd := &cobra.Command{
-		Use:   "config",
-		Short: "Open Smallweb configuration",
+		Use:         "config",
+		Annotations: map[string]string{localOnlyAnnotation: ""},
+		Short:       "Open Smallweb configuration",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			configPath := findConfigPath(k.String("dir"))
-			if flags.json || !isatty.IsTerminal(os.Stdout.Fd()) {
+			if flags.json || !isTerminal(cmd.OutOrStdout()) {
 				configBytes, err := os.ReadFile(configPath)
 				if err != nil {
 					cmd.PrintErrf("failed to read config file: %v\n", err)
@@ -53,10 +53,10 @@ func NewCmdConfig() *cobra.Command {
 					return ExitError{1}
 				}
 
-				encoder := json.NewEncoder(os.Stdout)
+				encoder := json.NewEncoder(cmd.OutOrStdout())
 				encoder.SetEscapeHTML(false)
 
-				if isatty.IsTerminal(os.Stdout.Fd()) {
+				if isTerminal(cmd.OutOrStdout()) {
 					encoder.SetIndent("", "  ")
 				}
 
@@ -75,9 +75,9 @@ func NewCmdConfig() *cobra.Command {
 
 			editCmd := exec.Command("sh", "-c", fmt.Sprintf("%s %s", editor, configPath))
 
-			editCmd.Stdout = os.Stdout
-			editCmd.Stderr = os.Stderr
-			editCmd.Stdin = os.Stdin
+			editCmd.Stdout = cmd.OutOrStdout()
+			editCmd.Stderr = cmd.ErrOrStderr()
+			editCmd.Stdin = cmd.InOrStdin()
 
 			if err := editCmd.Run(); err != nil {
 				var exitErr *exec.ExitError
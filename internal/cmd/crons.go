@@ -4,16 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
-	"os"
 	"time"
 
 	"github.com/cli/go-gh/v2/pkg/tableprinter"
-	"github.com/mattn/go-isatty"
 	"github.com/pomdtr/smallweb/internal/app"
-	"github.com/pomdtr/smallweb/internal/worker"
 	"github.com/robfig/cron/v3"
 	"github.com/spf13/cobra"
-	"golang.org/x/term"
 )
 
 type CronItem struct {
@@ -72,7 +68,7 @@ func NewCmdCronList() *cobra.Command {
 			if flags.json {
 				encoder := json.NewEncoder(cmd.OutOrStdout())
 				encoder.SetEscapeHTML(false)
-				if isatty.IsTerminal(os.Stdout.Fd()) {
+				if isTerminal(cmd.OutOrStdout()) {
 					encoder.SetIndent("", "  ")
 				}
 
@@ -89,8 +85,8 @@ func NewCmdCronList() *cobra.Command {
 			}
 
 			var printer tableprinter.TablePrinter
-			if isatty.IsTerminal(os.Stdout.Fd()) {
-				width, _, err := term.GetSize(int(os.Stdout.Fd()))
+			if isTerminal(cmd.OutOrStdout()) {
+				width, err := terminalWidth(cmd.OutOrStdout())
 				if err != nil {
 					cmd.PrintErrf("failed to get terminal size: %v\n", err)
 					return ExitError{1}
@@ -152,7 +148,7 @@ func NewCmdCronTrigger() *cobra.Command {
 				return ExitError{1}
 			}
 
-			wk := worker.NewWorker(a, nil)
+			wk := newWorker(a, nil)
 			if err := wk.TriggerCron(cmd.Context(), *job); err != nil {
 				return ExitError{1}
 			}
@@ -198,7 +194,7 @@ func CronRunner(logger *slog.Logger) *cron.Cron {
 					logger.Error("failed to load app", "app", appname, "error", err)
 					continue
 				}
-				wk := worker.NewWorker(a, nil)
+				wk := newWorker(a, nil)
 
 				logger.Info("running cron job", "app", appname, "name", job.Name, "schedule", job.Schedule)
 				go func(job app.CronJob) {
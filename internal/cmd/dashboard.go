@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/pomdtr/smallweb/internal/app"
+)
+
+type dashboardTab int
+
+const (
+	appsTab dashboardTab = iota
+	cronsTab
+	logsTab
+)
+
+var dashboardTabs = []string{"Apps", "Crons", "Logs"}
+
+type tickMsg time.Time
+
+type statusMsg string
+
+type Dashboard struct {
+	handler *Handler
+	tab     dashboardTab
+	cursor  int
+	width   int
+	height  int
+	apps    []app.App
+	crons   []CronItem
+	status  string
+	// loadedAt is when apps were last loaded, they are only reloaded after a change
+	loadedAt time.Time
+
+	titleStyle    lipgloss.Style
+	activeStyle   lipgloss.Style
+	inactiveStyle lipgloss.Style
+	headerStyle   lipgloss.Style
+	selectedStyle lipgloss.Style
+	mutedStyle    lipgloss.Style
+}
+
+// NewDashboard returns the terminal UI shown to ssh users connecting without a command.
+func NewDashboard(handler *Handler, renderer *lipgloss.Renderer) *Dashboard {
+	return &Dashboard{
+		handler:       handler,
+		titleStyle:    renderer.NewStyle().Bold(true).Foreground(lipgloss.Color("212")),
+		activeStyle:   renderer.NewStyle().Bold(true).Padding(0, 1).Background(lipgloss.Color("62")).Foreground(lipgloss.Color("230")),
+		inactiveStyle: renderer.NewStyle().Padding(0, 1).Foreground(lipgloss.Color("245")),
+		headerStyle:   renderer.NewStyle().Bold(true).Foreground(lipgloss.Color("245")),
+		selectedStyle: renderer.NewStyle().Foreground(lipgloss.Color("212")),
+		mutedStyle:    renderer.NewStyle().Foreground(lipgloss.Color("241")),
+	}
+}
+
+func (me *Dashboard) Init() tea.Cmd {
+	me.load()
+	return tick()
+}
+
+func tick() tea.Cmd {
+	return tea.Tick(2*time.Second, func(t time.Time) tea.Msg {
+		return tickMsg(t)
+	})
+}
+
+// refresh reloads the apps if they changed since they were loaded. Worker states are read
+// from the handler on each render.
+func (me *Dashboard) refresh() {
+	if me.handler.watcher != nil && !me.handler.watcher.ChangedAt().After(me.loadedAt) {
+		return
+	}
+
+	me.load()
+}
+
+// load reads the config of all the apps, decrypting their secrets.
+func (me *Dashboard) load() {
+	me.loadedAt = time.Now()
+	names, err := app.LookupApps(k.String("dir"))
+	if err != nil {
+		me.status = fmt.Sprintf("failed to list apps: %v", err)
+		return
+	}
+
+	me.apps = me.apps[:0]
+	me.crons = me.crons[:0]
+	for _, name := range names {
+		a, err := app.LoadApp(name, k.String("dir"), k.String("domain"))
+		if err != nil {
+			continue
+		}
+
+		me.apps = append(me.apps, a)
+		for _, job := range a.Config.Crons {
+			me.crons = append(me.crons, CronItem{
+				App:     name,
+				CronJob: job,
+			})
+		}
+	}
+
+	if me.cursor >= me.rows() {
+		me.cursor = max(me.rows()-1, 0)
+	}
+}
+
+func (me *Dashboard) rows() int {
+	switch me.tab {
+	case appsTab:
+		return len(me.apps)
+	case cronsTab:
+		return len(me.crons)
+	default:
+		return 0
+	}
+}
+
+func (me *Dashboard) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		me.width = msg.Width
+		me.height = msg.Height
+	case tickMsg:
+		me.refresh()
+		return me, tick()
+	case statusMsg:
+		me.status = string(msg)
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return me, tea.Quit
+		case "tab", "right", "l":
+			me.tab = (me.tab + 1) % dashboardTab(len(dashboardTabs))
+			me.cursor = 0
+		case "shift+tab", "left", "h":
+			me.tab = (me.tab + dashboardTab(len(dashboardTabs)) - 1) % dashboardTab(len(dashboardTabs))
+			me.cursor = 0
+		case "up", "k":
+			if me.cursor > 0 {
+				me.cursor--
+			}
+		case "down", "j":
+			if me.cursor < me.rows()-1 {
+				me.cursor++
+			}
+		case "r":
+			if me.tab != appsTab || len(me.apps) == 0 {
+				break
+			}
+
+			appname := me.apps[me.cursor].Name
+			me.status = fmt.Sprintf("restarting %s...", appname)
+			return me, me.restartWorker(appname)
+		case "t":
+			if me.tab != cronsTab || len(me.crons) == 0 {
+				break
+			}
+
+			item := me.crons[me.cursor]
+			me.status = fmt.Sprintf("running %s/%s...", item.App, item.Name)
+			return me, me.triggerCron(item)
+		}
+	}
+
+	return me, nil
+}
+
+func (me *Dashboard) restartWorker(appname string) tea.Cmd {
+	return func() tea.Msg {
+		if err := me.handler.RestartWorker(appname); err != nil {
+			return statusMsg(fmt.Sprintf("failed to restart %s: %v", appname, err))
+		}
+
+		return statusMsg(fmt.Sprintf("restarted %s", appname))
+	}
+}
+
+func (me *Dashboard) triggerCron(item CronItem) tea.Cmd {
+	return func() tea.Msg {
+		a, err := app.LoadApp(item.App, k.String("dir"), k.String("domain"))
+		if err != nil {
+			return statusMsg(fmt.Sprintf("failed to load app %s: %v", item.App, err))
+		}
+
+		logger := me.handler.logger.With("logger", "cron")
+		logger.Info("running cron job", "app", item.App, "name", item.Name, "schedule", item.Schedule)
+
+		wk := newWorker(a, nil)
+		if err := wk.TriggerCron(context.Background(), item.CronJob); err != nil {
+			logger.Error("failed to run command", "app", item.App, "name", item.Name, "schedule", item.Schedule, "error", err)
+			return statusMsg(fmt.Sprintf("cron %s/%s failed: %v", item.App, item.Name, err))
+		}
+
+		return statusMsg(fmt.Sprintf("cron %s/%s completed", item.App, item.Name))
+	}
+}
+
+func (me *Dashboard) View() string {
+	var sb strings.Builder
+
+	tabs := []string{me.titleStyle.Render("smallweb") + " "}
+	for i, name := range dashboardTabs {
+		if dashboardTab(i) == me.tab {
+			tabs = append(tabs, me.activeStyle.Render(name))
+		} else {
+			tabs = append(tabs, me.inactiveStyle.Render(name))
+		}
+	}
+	sb.WriteString(lipgloss.JoinHorizontal(lipgloss.Top, tabs...))
+	sb.WriteString("\n\n")
+
+	// header, blank line, and footer
+	height := me.height - 5
+	switch me.tab {
+	case appsTab:
+		sb.WriteString(me.appsView(height))
+	case cronsTab:
+		sb.WriteString(me.cronsView(height))
+	case logsTab:
+		sb.WriteString(me.logsView(height))
+	}
+
+	var help string
+	switch me.tab {
+	case appsTab:
+		help = "↑/↓ select • r restart worker • tab switch • q quit"
+	case cronsTab:
+		help = "↑/↓ select • t trigger cron • tab switch • q quit"
+	default:
+		help = "tab switch • q quit"
+	}
+
+	sb.WriteString("\n")
+	if me.status != "" {
+		sb.WriteString(me.truncate(me.status))
+	}
+	sb.WriteString("\n")
+	sb.WriteString(me.mutedStyle.Render(help))
+
+	return sb.String()
+}
+
+func (me *Dashboard) appsView(height int) string {
+	if len(me.apps) == 0 {
+		return me.fill([]string{me.mutedStyle.Render("No apps found")}, height)
+	}
+
+	rows := [][]string{{"Name", "Domain", "Worker", "Uptime", "Requests", "Memory"}}
+	for _, a := range me.apps {
+		status, uptime, requests, memory := "stopped", "-", "-", "-"
+		if wk, ok := me.handler.Worker(a.Name); ok {
+			status = "running"
+			uptime = time.Since(wk.StartedAt).Truncate(time.Second).String()
+			requests = fmt.Sprintf("%d", wk.ActiveRequests())
+
+			if usage, ok := wk.MemoryUsage(); ok {
+				memory = fmt.Sprintf("%dMiB", usage/1024/1024)
+			}
+
+			if wk.Limits.Memory > 0 {
+				memory = fmt.Sprintf("%s / %dMiB", memory, wk.Limits.Memory)
+			}
+		}
+
+		rows = append(rows, []string{a.Name, a.Domain, status, uptime, requests, memory})
+	}
+
+	return me.fill(me.table(rows, height), height)
+}
+
+func (me *Dashboard) cronsView(height int) string {
+	if len(me.crons) == 0 {
+		return me.fill([]string{me.mutedStyle.Render("No cron jobs found")}, height)
+	}
+
+	rows := [][]string{{"App", "Name", "Schedule"}}
+	for _, item := range me.crons {
+		rows = append(rows, []string{item.App, item.Name, item.Schedule})
+	}
+
+	return me.fill(me.table(rows, height), height)
+}
+
+func (me *Dashboard) logsView(height int) string {
+	entries := me.handler.logs.Entries()
+	if len(entries) > height {
+		entries = entries[len(entries)-height:]
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, me.truncate(entry.String()))
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, me.mutedStyle.Render("No logs yet"))
+	}
+
+	return me.fill(lines, height)
+}
+
+// table renders rows with aligned columns, the first row being the header.
+func (me *Dashboard) table(rows [][]string, height int) []string {
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], lipgloss.Width(cell))
+		}
+	}
+
+	format := func(row []string) string {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-lipgloss.Width(cell))
+		}
+
+		return me.truncate(strings.Join(cells, "  "))
+	}
+
+	lines := []string{me.headerStyle.Render("  " + format(rows[0]))}
+
+	// keep the selected row visible
+	body := rows[1:]
+	offset := 0
+	if height > 1 && me.cursor >= height-1 {
+		offset = me.cursor - (height - 2)
+	}
+
+	for i := offset; i < len(body); i++ {
+		line := format(body[i])
+		if i == me.cursor {
+			line = me.selectedStyle.Render("> " + line)
+		} else {
+			line = "  " + line
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// truncate cuts a line to the width of the terminal, without splitting multi-byte characters
+// nor escape sequences.
+func (me *Dashboard) truncate(line string) string {
+	if me.width <= 0 {
+		return line
+	}
+
+	return ansi.Truncate(line, me.width, "")
+}
+
+func (me *Dashboard) fill(lines []string, height int) string {
+	if height > 0 && len(lines) > height {
+		lines = lines[:height]
+	}
+
+	for len(lines) < height {
+		lines = append(lines, "")
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
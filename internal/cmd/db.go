@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cli/go-gh/v2/pkg/tableprinter"
+	"github.com/mattn/go-isatty"
+	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/database"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdDB() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Inspect the database of an app",
+		Long: `Inspect the SQLite database managed by smallweb for an app.
+
+The database is stored in data/smallweb.db, and its path is available to the app as SMALLWEB_DB_PATH.`,
+	}
+
+	cmd.AddCommand(NewCmdDBShell())
+	cmd.AddCommand(NewCmdDBQuery())
+
+	return cmd
+}
+
+func NewCmdDBQuery() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "query <app> <sql> [args...]",
+		Short: "Run a sql statement, and print the resulting rows as json",
+		Args:  cobra.MinimumNArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return completeApp(cmd, args, toComplete)
+			}
+
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openAppDatabase(args[0])
+			if err != nil {
+				cmd.PrintErrf("failed to open database: %v\n", err)
+				return ExitError{1}
+			}
+			defer db.Close()
+
+			var params []any
+			for _, arg := range args[2:] {
+				params = append(params, arg)
+			}
+
+			result, err := database.Query(cmd.Context(), db, args[1], params...)
+			if err != nil {
+				cmd.PrintErrf("failed to run query: %v\n", err)
+				return ExitError{1}
+			}
+
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetEscapeHTML(false)
+			if isTerminal(cmd.OutOrStdout()) {
+				encoder.SetIndent("", "  ")
+			}
+
+			if err := encoder.Encode(result.Records()); err != nil {
+				cmd.PrintErrf("failed to encode rows as json: %v\n", err)
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func NewCmdDBShell() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "shell <app>",
+		Short:             "Start an interactive sql shell",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeApp,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openAppDatabase(args[0])
+			if err != nil {
+				cmd.PrintErrf("failed to open database: %v\n", err)
+				return ExitError{1}
+			}
+			defer db.Close()
+
+			interactive := false
+			if f, ok := cmd.InOrStdin().(*os.File); ok && isatty.IsTerminal(f.Fd()) {
+				interactive = true
+				cmd.Printf("Connected to the database of %s, end statements with ; and type .help for usage hints.\n", args[0])
+			}
+
+			var statement strings.Builder
+			scanner := bufio.NewScanner(cmd.InOrStdin())
+			for {
+				if interactive {
+					if statement.Len() == 0 {
+						cmd.Print("sqlite> ")
+					} else {
+						cmd.Print("   ...> ")
+					}
+				}
+
+				if !scanner.Scan() {
+					break
+				}
+
+				line := strings.TrimSpace(scanner.Text())
+				if statement.Len() == 0 && strings.HasPrefix(line, ".") {
+					if line == ".quit" || line == ".exit" {
+						return nil
+					}
+
+					if err := runDotCommand(cmd, db, line); err != nil {
+						cmd.PrintErrf("Error: %v\n", err)
+						if !interactive {
+							return ExitError{1}
+						}
+					}
+
+					continue
+				}
+
+				if line == "" && statement.Len() == 0 {
+					continue
+				}
+
+				statement.WriteString(scanner.Text())
+				statement.WriteString("\n")
+				if !strings.HasSuffix(line, ";") {
+					continue
+				}
+
+				query := statement.String()
+				statement.Reset()
+
+				result, err := database.Query(cmd.Context(), db, query)
+				if err != nil {
+					cmd.PrintErrf("Error: %v\n", err)
+					if !interactive {
+						return ExitError{1}
+					}
+
+					continue
+				}
+
+				if err := printResult(cmd.OutOrStdout(), result); err != nil {
+					return err
+				}
+			}
+
+			if err := scanner.Err(); err != nil && err != io.EOF {
+				cmd.PrintErrf("failed to read input: %v\n", err)
+				return ExitError{1}
+			}
+
+			if interactive {
+				cmd.Println()
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func openAppDatabase(appname string) (*sql.DB, error) {
+	a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load app %s: %w", appname, err)
+	}
+
+	return database.Open(a.DatabasePath())
+}
+
+func runDotCommand(cmd *cobra.Command, db *sql.DB, line string) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ".help":
+		cmd.Println(`.exit, .quit       Exit the shell
+.help              Show this message
+.schema [table]    Show the create statements
+.tables            List the tables`)
+		return nil
+	case ".tables":
+		result, err := database.Query(cmd.Context(), db, "SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+		if err != nil {
+			return err
+		}
+
+		for _, row := range result.Rows {
+			cmd.Println(row[0])
+		}
+
+		return nil
+	case ".schema":
+		query := "SELECT sql FROM sqlite_schema WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'"
+		var params []any
+		if len(fields) > 1 {
+			query += " AND tbl_name = ?"
+			params = append(params, fields[1])
+		}
+
+		result, err := database.Query(cmd.Context(), db, query+" ORDER BY tbl_name, type DESC, name", params...)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range result.Rows {
+			cmd.Printf("%s;\n", row[0])
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown command %s, type .help for usage hints", fields[0])
+	}
+}
+
+func printResult(w io.Writer, result database.Result) error {
+	if len(result.Columns) == 0 {
+		return nil
+	}
+
+	var printer tableprinter.TablePrinter
+	if isTerminal(w) {
+		width, err := terminalWidth(w)
+		if err != nil {
+			return fmt.Errorf("failed to get terminal size: %w", err)
+		}
+
+		printer = tableprinter.New(w, true, width)
+	} else {
+		printer = tableprinter.New(w, false, 0)
+	}
+
+	printer.AddHeader(result.Columns)
+	for _, row := range result.Rows {
+		for _, value := range row {
+			if value == nil {
+				printer.AddField("NULL")
+				continue
+			}
+
+			printer.AddField(fmt.Sprint(value))
+		}
+
+		printer.EndRow()
+	}
+
+	return printer.Render()
+}
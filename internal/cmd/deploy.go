@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/archive"
+	"github.com/pomdtr/smallweb/internal/utils"
+	"github.com/pomdtr/smallweb/internal/worker"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdDeploy() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deploy <app> <path|tarball>",
+		Short: "Deploy a new release of an app from a directory or a tarball",
+		Long: `Deploy a new release of an app from a directory or a tarball.
+
+Use - to read a tarball from stdin, e.g. tar -cz . | ssh smallweb.run deploy <app> -`,
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeApp,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			appname, source := args[0], args[1]
+			if isRemote(cmd) && source != "-" {
+				cmd.PrintErrln("over ssh, the tarball can only be read from stdin, e.g. tar -cz . | ssh smallweb.run deploy <app> -")
+				return ExitError{1}
+			}
+
+			populate := func(dir string) error {
+				if source == "-" {
+					return archive.Extract(cmd.InOrStdin(), dir)
+				}
+
+				info, err := os.Stat(source)
+				if err != nil {
+					return err
+				}
+
+				if info.IsDir() {
+					return copyAppDir(source, dir)
+				}
+
+				f, err := os.Open(source)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				return archive.Extract(f, dir)
+			}
+
+			if !utils.FileExists(filepath.Join(k.String("dir"), appname)) {
+				if err := createApp(appname); err != nil {
+					cmd.PrintErrf("failed to create app %s: %v\n", appname, err)
+					return ExitError{1}
+				}
+
+				cmd.PrintErrf("Created app %s\n", appname)
+				defer removeEmptyApp(appname)
+			}
+
+			release, err := deployRelease(appname, populate, cmd.ErrOrStderr())
+			if err != nil {
+				cmd.PrintErrf("failed to deploy %s: %v\n", appname, err)
+				return ExitError{1}
+			}
+
+			cmd.PrintErrf("Deployed release %s to https://%s.%s/\n", release, appname, k.String("domain"))
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func NewCmdRollback() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback <app> [release]",
+		Short: "Serve a previous release of an app",
+		Args:  cobra.RangeArgs(1, 2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return completeApp(cmd, args, toComplete)
+			}
+
+			if len(args) > 1 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			releases, err := app.Releases(filepath.Join(k.String("dir"), args[0]))
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			return releases, cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveKeepOrder
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := app.LoadApp(args[0], k.String("dir"), k.String("domain"))
+			if err != nil {
+				cmd.PrintErrf("failed to load app %s: %v\n", args[0], err)
+				return ExitError{1}
+			}
+
+			releases, err := app.Releases(a.BaseDir)
+			if err != nil {
+				cmd.PrintErrf("failed to list releases: %v\n", err)
+				return ExitError{1}
+			}
+
+			var release string
+			if len(args) > 1 {
+				release = args[1]
+			} else {
+				// roll back to the release deployed before the current one
+				for i, id := range releases {
+					if id == a.Release && i > 0 {
+						release = releases[i-1]
+					}
+				}
+
+				if release == "" {
+					cmd.PrintErrf("no previous release found for %s\n", a.Name)
+					return ExitError{1}
+				}
+			}
+
+			if err := app.ActivateRelease(a.BaseDir, release); err != nil {
+				cmd.PrintErrf("failed to roll back to release %s: %v\n", release, err)
+				return ExitError{1}
+			}
+
+			cmd.PrintErrf("Rolled back %s to release %s\n", a.Name, release)
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+// keepReleases returns the number of releases kept for each app.
+func keepReleases() int {
+	if k.Exists("keepReleases") {
+		return max(k.Int("keepReleases"), 1)
+	}
+
+	return 5
+}
+
+// deployRelease creates a release of an app, runs its build command and serves it.
+// The served release is left untouched if any step fails.
+func deployRelease(appname string, populate func(dir string) error, output io.Writer) (string, error) {
+	appDir := filepath.Join(k.String("dir"), appname)
+	release, err := app.CreateRelease(appDir, func(dir string) error {
+		if err := populate(dir); err != nil {
+			return err
+		}
+
+		if _, err := app.LoadConfig(dir); err != nil {
+			return err
+		}
+
+		// the build runs on the host, so it is only read from the smallweb config, never from the pushed files
+		if build := k.String(fmt.Sprintf("apps.%s.build", appname)); build != "" {
+			fmt.Fprintf(output, "Running %s\n", build)
+			if err := runBuild(build, dir, output); err != nil {
+				return fmt.Errorf("build failed: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := app.ActivateRelease(appDir, release); err != nil {
+		return "", err
+	}
+
+	if err := app.PruneReleases(appDir, keepReleases()); err != nil {
+		fmt.Fprintf(output, "failed to remove old releases: %v\n", err)
+	}
+
+	return release, nil
+}
+
+// copyAppDir copies the files of an app to dir, leaving out its runtime state and releases.
+func copyAppDir(src string, dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		switch name {
+		case ".git", "data", ".env", app.ReleasesDirName, app.CurrentLinkName:
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return root.Mkdir(name, 0755)
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			return root.Symlink(target, name)
+		case info.Mode().IsRegular():
+			return copyFile(root, path, name, info.Mode().Perm())
+		}
+
+		return nil
+	})
+}
+
+func copyFile(root *os.Root, src string, name string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// buildEnv lists the variables of the server passed to build commands. The others, e.g. the
+// credentials of the server, are left out.
+var buildEnv = []string{"HOME", "LANG", "TMPDIR", "TZ", "XDG_CACHE_HOME"}
+
+func runBuild(command string, dir string, output io.Writer) error {
+	buildCmd := exec.Command("sh", "-c", command)
+	buildCmd.Dir = dir
+	buildCmd.Stdout = output
+	buildCmd.Stderr = output
+
+	for _, key := range buildEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			buildCmd.Env = append(buildCmd.Env, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+
+	// make sure build commands use the same deno as the workers
+	path := os.Getenv("PATH")
+	if deno, err := worker.DenoExecutable(); err == nil {
+		path = fmt.Sprintf("%s%c%s", filepath.Dir(deno), os.PathListSeparator, path)
+	}
+	buildCmd.Env = append(buildCmd.Env, "PATH="+path)
+
+	return buildCmd.Run()
+}
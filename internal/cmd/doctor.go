@@ -15,8 +15,9 @@ var minimumDenoVersion = semver.MustParse("2.4.0")
 
 func NewCmdDoctor() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "doctor",
-		Short: "Check the system for potential problems",
+		Use:         "doctor",
+		Annotations: map[string]string{localOnlyAnnotation: ""},
+		Short:       "Check the system for potential problems",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			fmt.Fprintln(cmd.ErrOrStderr(), "🔍 Checking smallweb directory...")
 			if _, err := os.Stat(k.String("dir")); os.IsNotExist(err) {
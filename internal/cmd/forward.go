@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/pomdtr/smallweb/internal/app"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// direct-tcpip data struct as specified in RFC4254, Section 7.2
+type localForwardChannelData struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// PortForwardingOption allows ssh clients to reach app workers using local port forwarding,
+// e.g. ssh -L 8000:<app>:80 _@<domain>. App keys can only reach their own app.
+func PortForwardingOption(handler *Handler, logger *slog.Logger) ssh.Option {
+	return func(server *ssh.Server) error {
+		if server.ChannelHandlers == nil {
+			server.ChannelHandlers = map[string]ssh.ChannelHandler{}
+			for name, channelHandler := range ssh.DefaultChannelHandlers {
+				server.ChannelHandlers[name] = channelHandler
+			}
+		}
+
+		server.ChannelHandlers["direct-tcpip"] = func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+			var data localForwardChannelData
+			if err := gossh.Unmarshal(newChan.ExtraData(), &data); err != nil {
+				newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+				return
+			}
+
+			if data.DestPort != 80 {
+				newChan.Reject(gossh.Prohibited, "only port 80 can be forwarded")
+				return
+			}
+
+			appname := data.DestAddr
+			if strings.Contains(appname, ".") {
+				name, _, ok := lookupApp(appname)
+				if !ok {
+					newChan.Reject(gossh.ConnectionFailed, fmt.Sprintf("no app found for hostname %s", data.DestAddr))
+					return
+				}
+
+				appname = name
+			}
+
+			if !permissionsFromContext(ctx).CanAccessApp(appname) {
+				newChan.Reject(gossh.Prohibited, fmt.Sprintf("key is not authorized for app %s", appname))
+				return
+			}
+
+			if _, err := app.LoadApp(appname, k.String("dir"), k.String("domain")); err != nil {
+				if errors.Is(err, app.ErrAppNotFound) {
+					newChan.Reject(gossh.ConnectionFailed, fmt.Sprintf("app %s not found", appname))
+					return
+				}
+
+				newChan.Reject(gossh.ConnectionFailed, err.Error())
+				return
+			}
+
+			ch, reqs, err := newChan.Accept()
+			if err != nil {
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+
+			logger.Info("port forwarding", "user", ctx.User(), "remote addr", ctx.RemoteAddr().String(), "app", appname)
+
+			listener := newChannelListener(&channelConn{
+				Channel:    ch,
+				localAddr:  ctx.LocalAddr(),
+				remoteAddr: ctx.RemoteAddr(),
+			})
+
+			httpServer := &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handler.serveApp(w, r, appname)
+				}),
+			}
+
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					httpServer.Close()
+				case <-done:
+				}
+			}()
+
+			_ = httpServer.Serve(listener)
+		}
+
+		return nil
+	}
+}
+
+// channelConn exposes an ssh channel as a net.Conn.
+type channelConn struct {
+	gossh.Channel
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *channelConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *channelConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *channelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// channelListener is a net.Listener accepting a single connection.
+type channelListener struct {
+	conn   chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	addr   net.Addr
+}
+
+func newChannelListener(conn *channelConn) *channelListener {
+	ln := &channelListener{
+		conn:   make(chan net.Conn, 1),
+		closed: make(chan struct{}),
+		addr:   conn.LocalAddr(),
+	}
+
+	ln.conn <- &closeNotifyConn{Conn: conn, onClose: ln.Close}
+	return ln
+}
+
+func (ln *channelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conn:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *channelListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.closed)
+	})
+
+	return nil
+}
+
+func (ln *channelListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// closeNotifyConn closes the listener once the connection is closed, stopping the http server.
+type closeNotifyConn struct {
+	net.Conn
+	onClose func() error
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	_ = c.onClose()
+	return err
+}
@@ -1,10 +1,20 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/archive"
+	"github.com/pomdtr/smallweb/internal/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -14,19 +24,35 @@ func NewCmdGitReceivePack() *cobra.Command {
 		Hidden: true,
 		Args:   cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			a, err := app.LoadApp(args[0], k.String("dir"), k.String("domain"))
-			if err != nil {
-				cmd.PrintErrf("failed to load app %s: %v\n", args[0], err)
+			// a broken app config should not prevent pushing a fix, so the app is not loaded
+			appname := repoAppName(args[0])
+			if appname == "" || strings.ContainsAny(appname, `./\`) {
+				cmd.PrintErrf("failed to load app %s: %v\n", appname, app.ErrAppNotFound)
 				return ExitError{1}
 			}
 
-			gitCmd := exec.Command("git-receive-pack", a.BaseDir)
+			// the first push to an unknown app creates it
+			if !utils.FileExists(filepath.Join(k.String("dir"), appname)) {
+				if err := createApp(appname); err != nil {
+					cmd.PrintErrf("failed to create app %s: %v\n", appname, err)
+					return ExitError{1}
+				}
+
+				cmd.PrintErrf("Created app %s\n", appname)
+				defer removeEmptyApp(appname)
+			}
 
-			gitCmd.Stdin = cmd.InOrStdin()
+			repoDir, err := initRepo(appname)
+			if err != nil {
+				cmd.PrintErrf("failed to init repository: %v\n", err)
+				return ExitError{1}
+			}
+
+			gitCmd := exec.Command("git-receive-pack", repoDir)
 			gitCmd.Stdout = cmd.OutOrStdout()
 			gitCmd.Stderr = cmd.ErrOrStderr()
 
-			if err := gitCmd.Run(); err != nil {
+			if err := runWithStdin(gitCmd, cmd.InOrStdin()); err != nil {
 				var exitErr *exec.ExitError
 				if errors.As(err, &exitErr) {
 					return ExitError{exitErr.ExitCode()}
@@ -48,19 +74,29 @@ func NewCmdGitUploadPack() *cobra.Command {
 		Args:   cobra.ExactArgs(1),
 		Hidden: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			a, err := app.LoadApp(args[0], k.String("dir"), k.String("domain"))
+			appname := repoAppName(args[0])
+			if appname == "" || strings.ContainsAny(appname, `./\`) {
+				cmd.PrintErrf("failed to load app %s: %v\n", appname, app.ErrAppNotFound)
+				return ExitError{1}
+			}
+
+			a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
 			if err != nil {
-				cmd.PrintErrf("failed to load app %s: %v\n", args[0], err)
+				cmd.PrintErrf("failed to load app %s: %v\n", appname, err)
 				return ExitError{1}
 			}
 
-			gitCmd := exec.Command("git-upload-pack", a.BaseDir)
+			// apps deployed with git push are served from their bare repository
+			dir := a.BaseDir
+			if repoDir := repoPath(appname); utils.FileExists(repoDir) {
+				dir = repoDir
+			}
 
-			gitCmd.Stdin = cmd.InOrStdin()
+			gitCmd := exec.Command("git-upload-pack", dir)
 			gitCmd.Stdout = cmd.OutOrStdout()
 			gitCmd.Stderr = cmd.ErrOrStderr()
 
-			if err := gitCmd.Run(); err != nil {
+			if err := runWithStdin(gitCmd, cmd.InOrStdin()); err != nil {
 				var exitErr *exec.ExitError
 				if errors.As(err, &exitErr) {
 					return ExitError{exitErr.ExitCode()}
@@ -75,3 +111,217 @@ func NewCmdGitUploadPack() *cobra.Command {
 
 	return cmd
 }
+
+// runWithStdin runs command without waiting for stdin to be closed, as ssh clients may keep it open.
+func runWithStdin(command *exec.Cmd, stdin io.Reader) error {
+	pipe, err := command.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer pipe.Close()
+		io.Copy(pipe, stdin)
+	}()
+
+	return command.Run()
+}
+
+const zeroRev = "0000000000000000000000000000000000000000"
+
+var appNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// repoAppName extracts the app name from the repository path sent by git clients,
+// e.g. "blog", "/blog" or "blog.git".
+func repoAppName(repo string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(repo, "/"), ".git")
+}
+
+// checkAppName reports whether an app can be created with the given name.
+func checkAppName(appname string) error {
+	if !appNameRegexp.MatchString(appname) {
+		return fmt.Errorf("invalid app name, only lowercase letters, digits and hyphens are allowed")
+	}
+
+	if name, ok := gitDomainApp(); ok && name == appname {
+		return fmt.Errorf("app name %s is reserved, %s serves the app repositories", appname, gitDomain())
+	}
+
+	return nil
+}
+
+// createApp creates the dir of an app pushed for the first time.
+func createApp(appname string) error {
+	if err := checkAppName(appname); err != nil {
+		return err
+	}
+
+	return os.Mkdir(filepath.Join(k.String("dir"), appname), 0755)
+}
+
+// removeEmptyApp removes an app created by a push which did not deploy anything.
+func removeEmptyApp(appname string) {
+	if err := os.Remove(filepath.Join(k.String("dir"), appname)); err == nil {
+		_ = os.RemoveAll(repoPath(appname))
+	}
+}
+
+func repoPath(appname string) string {
+	return filepath.Join(k.String("dir"), ".smallweb", "repos", appname+".git")
+}
+
+// initRepo creates the bare repository receiving the pushes of an app,
+// and installs the pre-receive hook deploying them.
+func initRepo(appname string) (string, error) {
+	repoDir := repoPath(appname)
+	if !utils.FileExists(repoDir) {
+		initCmd := exec.Command("git", "init", "--quiet", "--bare", repoDir)
+		if output, err := initCmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("git init failed: %s", output)
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("could not find smallweb executable: %w", err)
+	}
+
+	// the hook is rewritten on each push, as the executable may have moved
+	hook := fmt.Sprintf("#!/bin/sh\nSMALLWEB_DIR=%s exec %s git-deploy %s\n", shellQuote(k.String("dir")), shellQuote(executable), shellQuote(appname))
+	if err := os.WriteFile(filepath.Join(repoDir, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		return "", fmt.Errorf("could not write pre-receive hook: %w", err)
+	}
+
+	return repoDir, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func NewCmdGitDeploy() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "git-deploy <app>",
+		Short:       "Deploy the branch pushed to an app repository",
+		Hidden:      true,
+		Annotations: map[string]string{localOnlyAnnotation: ""},
+		Args:        cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			headRef, err := gitOutput("symbolic-ref", "HEAD")
+			if err != nil {
+				cmd.PrintErrf("failed to read HEAD: %v\n", err)
+				return ExitError{1}
+			}
+
+			_, headErr := gitOutput("rev-parse", "--verify", "--quiet", "HEAD")
+			emptyRepo := headErr != nil
+
+			// pre-receive hooks receive one "<old-rev> <new-rev> <ref>" line per updated ref
+			updates := make(map[string]string)
+			var branches []string
+			scanner := bufio.NewScanner(cmd.InOrStdin())
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) != 3 {
+					continue
+				}
+
+				updates[fields[2]] = fields[1]
+				if strings.HasPrefix(fields[2], "refs/heads/") {
+					branches = append(branches, fields[2])
+				}
+			}
+
+			// the first pushed branch becomes the deployed one
+			if _, ok := updates[headRef]; !ok && emptyRepo {
+				if len(branches) == 0 {
+					cmd.PrintErrln("the first push must include a branch")
+					return ExitError{1}
+				}
+
+				if _, err := gitOutput("symbolic-ref", "HEAD", branches[0]); err != nil {
+					cmd.PrintErrf("failed to update HEAD: %v\n", err)
+					return ExitError{1}
+				}
+
+				headRef = branches[0]
+			}
+
+			rev, ok := updates[headRef]
+			if !ok {
+				return nil
+			}
+
+			if rev == zeroRev {
+				cmd.PrintErrf("%s is deployed, it cannot be deleted\n", strings.TrimPrefix(headRef, "refs/heads/"))
+				return ExitError{1}
+			}
+
+			if err := deployRev(args[0], rev, cmd.ErrOrStderr()); err != nil {
+				cmd.PrintErrf("deploy failed: %v\n", err)
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func gitOutput(args ...string) (string, error) {
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s", bytes.TrimSpace(exitErr.Stderr))
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// deployRev creates a release from a commit, and serves it.
+func deployRev(appname string, rev string, output io.Writer) error {
+	fmt.Fprintf(output, "Checking out %s\n", rev[:7])
+	release, err := deployRelease(appname, func(dir string) error {
+		if err := extractRev(rev, dir); err != nil {
+			return fmt.Errorf("could not check out %s: %w", rev, err)
+		}
+
+		return nil
+	}, output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Deployed %s as release %s to https://%s.%s/\n", rev[:7], release, appname, k.String("domain"))
+	return nil
+}
+
+// extractRev writes the tree of a commit to dir.
+func extractRev(rev string, dir string) error {
+	archiveCmd := exec.Command("git", "archive", "--format=tar", rev)
+	stdout, err := archiveCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	archiveCmd.Stderr = &stderr
+	if err := archiveCmd.Start(); err != nil {
+		return err
+	}
+
+	extractErr := archive.Extract(stdout, dir)
+	// drain the archive, so that git can exit
+	_, _ = io.Copy(io.Discard, stdout)
+
+	if err := archiveCmd.Wait(); err != nil {
+		return fmt.Errorf("git archive failed: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return extractErr
+}
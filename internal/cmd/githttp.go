@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pomdtr/smallweb/internal/utils"
+)
+
+// gitDomain returns the host serving app repositories over https.
+func gitDomain() string {
+	if domain := k.String("gitDomain"); domain != "" {
+		return domain
+	}
+
+	return fmt.Sprintf("git.%s", k.String("domain"))
+}
+
+// checkToken reports whether the request is authenticated with a token allowed to access the
+// repository of the app: either one of the global authorizedTokens, or one of the tokens listed
+// in apps.<app>.authorizedTokens. Git clients send tokens using basic auth, either as the
+// username or the password.
+func checkToken(r *http.Request, appname string) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	tokens := k.Strings("authorizedTokens")
+	if appname != "" {
+		tokens = append(tokens, k.Strings(fmt.Sprintf("apps.%s.authorizedTokens", appname))...)
+	}
+
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(password)) == 1 || subtle.ConstantTimeCompare([]byte(token), []byte(username)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gitDomainApp returns the app whose domain is the git domain, if any. Its requests would be
+// served as repositories, so no app can use this name.
+func gitDomainApp() (string, bool) {
+	appname, redirect, ok := lookupApp(gitDomain())
+	if !ok || redirect {
+		return "", false
+	}
+
+	return appname, true
+}
+
+// serveGit serves the app repositories using the git smart http protocol,
+// e.g. git clone https://git.<domain>/<app>.git
+func (me *Handler) serveGit(w http.ResponseWriter, r *http.Request) {
+	repo, endpoint, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	appname := repoAppName(repo)
+	if appname == "" || strings.ContainsAny(appname, `./\`) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !checkToken(r, appname) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="smallweb"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var service string
+	switch endpoint {
+	case "info/refs":
+		service = r.URL.Query().Get("service")
+	case "git-upload-pack", "git-receive-pack":
+		service = endpoint
+	}
+
+	appDir := filepath.Join(k.String("dir"), appname)
+	projectRoot, pathInfo := filepath.Dir(repoPath(appname)), fmt.Sprintf("/%s.git/%s", appname, endpoint)
+	switch service {
+	case "git-upload-pack":
+		if !utils.FileExists(appDir) {
+			http.Error(w, fmt.Sprintf("app %s not found", appname), http.StatusNotFound)
+			return
+		}
+
+		// apps which were never pushed are served from their own repository
+		if !utils.FileExists(repoPath(appname)) {
+			projectRoot, pathInfo = k.String("dir"), fmt.Sprintf("/%s/%s", appname, endpoint)
+		}
+	case "git-receive-pack":
+		// the first push to an unknown app creates it. Pushes start by listing the refs of the
+		// repository, so the app is only created by the request receiving the pack, and removed
+		// if it failed to deploy anything.
+		if !utils.FileExists(appDir) {
+			if endpoint == "info/refs" {
+				if err := checkAppName(appname); err != nil {
+					http.Error(w, fmt.Sprintf("failed to create app %s: %v", appname, err), http.StatusBadRequest)
+					return
+				}
+			} else {
+				if err := createApp(appname); err != nil {
+					http.Error(w, fmt.Sprintf("failed to create app %s: %v", appname, err), http.StatusBadRequest)
+					return
+				}
+
+				defer removeEmptyApp(appname)
+			}
+		}
+
+		if _, err := initRepo(appname); err != nil {
+			http.Error(w, fmt.Sprintf("failed to init repository: %v", err), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "only the smart http protocol is supported", http.StatusForbidden)
+		return
+	}
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		http.Error(w, "git is not installed", http.StatusInternalServerError)
+		return
+	}
+
+	r.URL.Path = pathInfo
+	handler := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Dir:  projectRoot,
+		Env: append(
+			os.Environ(),
+			fmt.Sprintf("GIT_PROJECT_ROOT=%s", projectRoot),
+			"GIT_HTTP_EXPORT_ALL=1",
+			// enables receive-pack, which http-backend only allows for authenticated users
+			"REMOTE_USER=smallweb",
+		),
+	}
+
+	handler.ServeHTTP(w, r)
+}
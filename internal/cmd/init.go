@@ -14,9 +14,10 @@ var embedFS embed.FS
 
 func NewCmdInit() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "init",
-		Args:  cobra.NoArgs,
-		Short: "Initialize a new workspace",
+		Use:         "init",
+		Annotations: map[string]string{localOnlyAnnotation: ""},
+		Args:        cobra.NoArgs,
+		Short:       "Initialize a new workspace",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			domain := k.String("domain")
 			if domain == "" {
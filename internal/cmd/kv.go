@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/kv"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdKV() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kv",
+		Short: "Manage the key-value store of an app",
+		Long: `Manage the key-value store of an app.
+
+Apps access their store over http, using the SMALLWEB_KV_URL and SMALLWEB_KV_TOKEN env vars:
+
+  GET    $SMALLWEB_KV_URL/?prefix=<prefix>  list keys as a json array
+  GET    $SMALLWEB_KV_URL/<key>             read a value
+  PUT    $SMALLWEB_KV_URL/<key>             write the request body as the value
+  DELETE $SMALLWEB_KV_URL/<key>             delete a value
+
+Requests must include an "Authorization: Bearer $SMALLWEB_KV_TOKEN" header.`,
+	}
+
+	cmd.AddCommand(NewCmdKVGet())
+	cmd.AddCommand(NewCmdKVSet())
+	cmd.AddCommand(NewCmdKVList())
+	cmd.AddCommand(NewCmdKVDelete())
+
+	return cmd
+}
+
+func openAppStore(appname string) (*kv.Store, error) {
+	a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load app %s: %w", appname, err)
+	}
+
+	return kv.Open(a.KVPath())
+}
+
+func NewCmdKVGet() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "get <app> <key>",
+		Short:             "Print the value of a key",
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeKey,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openAppStore(args[0])
+			if err != nil {
+				cmd.PrintErrf("failed to open store: %v\n", err)
+				return ExitError{1}
+			}
+			defer store.Close()
+
+			value, err := store.Get(cmd.Context(), args[1])
+			if err != nil {
+				if errors.Is(err, kv.ErrKeyNotFound) {
+					cmd.PrintErrf("key %s not found\n", args[1])
+					return ExitError{1}
+				}
+
+				cmd.PrintErrf("failed to get key: %v\n", err)
+				return ExitError{1}
+			}
+
+			if _, err := cmd.OutOrStdout().Write(value); err != nil {
+				return err
+			}
+
+			// keep the shell prompt on its own line
+			if isTerminal(cmd.OutOrStdout()) && len(value) > 0 && value[len(value)-1] != '\n' {
+				cmd.Println()
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func NewCmdKVSet() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set <app> <key> [value]",
+		Short: "Set the value of a key",
+		Long: `Set the value of a key.
+
+The value is read from stdin when it is not given as an argument.`,
+		Args:              cobra.RangeArgs(2, 3),
+		ValidArgsFunction: completeKey,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openAppStore(args[0])
+			if err != nil {
+				cmd.PrintErrf("failed to open store: %v\n", err)
+				return ExitError{1}
+			}
+			defer store.Close()
+
+			var value []byte
+			if len(args) > 2 {
+				value = []byte(args[2])
+			} else {
+				value, err = io.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					cmd.PrintErrf("failed to read value from stdin: %v\n", err)
+					return ExitError{1}
+				}
+			}
+
+			if err := store.Set(cmd.Context(), args[1], value); err != nil {
+				cmd.PrintErrf("failed to set key: %v\n", err)
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func NewCmdKVList() *cobra.Command {
+	var flags struct {
+		json bool
+	}
+
+	cmd := &cobra.Command{
+		Use:     "list <app> [prefix]",
+		Short:   "List the keys of an app",
+		Aliases: []string{"ls"},
+		Args:    cobra.RangeArgs(1, 2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return completeApp(cmd, args, toComplete)
+			}
+
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openAppStore(args[0])
+			if err != nil {
+				cmd.PrintErrf("failed to open store: %v\n", err)
+				return ExitError{1}
+			}
+			defer store.Close()
+
+			var prefix string
+			if len(args) > 1 {
+				prefix = args[1]
+			}
+
+			keys, err := store.List(cmd.Context(), prefix)
+			if err != nil {
+				cmd.PrintErrf("failed to list keys: %v\n", err)
+				return ExitError{1}
+			}
+
+			if flags.json {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetEscapeHTML(false)
+				if isTerminal(cmd.OutOrStdout()) {
+					encoder.SetIndent("", "  ")
+				}
+
+				if err := encoder.Encode(keys); err != nil {
+					cmd.PrintErrf("failed to encode keys as json: %v\n", err)
+					return ExitError{1}
+				}
+
+				return nil
+			}
+
+			for _, key := range keys {
+				cmd.Println(key)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&flags.json, "json", false, "output as json")
+
+	return cmd
+}
+
+func NewCmdKVDelete() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "delete <app> <key>",
+		Short:             "Delete a key",
+		Aliases:           []string{"rm"},
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeKey,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openAppStore(args[0])
+			if err != nil {
+				cmd.PrintErrf("failed to open store: %v\n", err)
+				return ExitError{1}
+			}
+			defer store.Close()
+
+			if err := store.Delete(cmd.Context(), args[1]); err != nil {
+				if errors.Is(err, kv.ErrKeyNotFound) {
+					cmd.PrintErrf("key %s not found\n", args[1])
+					return ExitError{1}
+				}
+
+				cmd.PrintErrf("failed to delete key: %v\n", err)
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func completeKey(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeApp(cmd, args, toComplete)
+	}
+
+	if len(args) > 1 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	store, err := openAppStore(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer store.Close()
+
+	keys, err := store.List(cmd.Context(), toComplete)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	return keys, cobra.ShellCompDirectiveNoFileComp
+}
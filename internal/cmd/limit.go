@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/pomdtr/smallweb/internal/worker"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdLimitExec() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                worker.LimitExecCommand + " <files> -- <command> [args...]",
+		Short:              "Run a command with a limit of open files",
+		Hidden:             true,
+		Annotations:        map[string]string{localOnlyAnnotation: ""},
+		DisableFlagParsing: true,
+		Args:               cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if args[1] != "--" {
+				cmd.PrintErrln("expected -- after the files limit")
+				return ExitError{1}
+			}
+
+			files, err := strconv.Atoi(args[0])
+			if err != nil || files < 1 {
+				cmd.PrintErrf("invalid files limit: %s\n", args[0])
+				return ExitError{1}
+			}
+
+			// exec only returns on failure
+			if err := worker.LimitExec(files, args[2:]); err != nil {
+				cmd.PrintErrf("failed to run command: %v\n", err)
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
@@ -7,10 +7,8 @@ import (
 	"strings"
 
 	"github.com/cli/go-gh/v2/pkg/tableprinter"
-	"github.com/mattn/go-isatty"
 	"github.com/pomdtr/smallweb/internal/app"
 	"github.com/spf13/cobra"
-	"golang.org/x/term"
 )
 
 func NewCmdList() *cobra.Command {
@@ -47,7 +45,7 @@ func NewCmdList() *cobra.Command {
 			if flags.json {
 				encoder := json.NewEncoder(cmd.OutOrStdout())
 				encoder.SetEscapeHTML(false)
-				if isatty.IsTerminal(os.Stdout.Fd()) {
+				if isTerminal(cmd.OutOrStdout()) {
 					encoder.SetIndent("", "  ")
 				}
 
@@ -65,8 +63,8 @@ func NewCmdList() *cobra.Command {
 			}
 
 			var printer tableprinter.TablePrinter
-			if isatty.IsTerminal(os.Stdout.Fd()) {
-				width, _, err := term.GetSize(int(os.Stdout.Fd()))
+			if isTerminal(cmd.OutOrStdout()) {
+				width, err := terminalWidth(cmd.OutOrStdout())
 				if err != nil {
 					return fmt.Errorf("failed to get terminal size: %w", err)
 				}
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/adrg/xdg"
 	"github.com/knadh/koanf/providers/confmap"
@@ -14,6 +15,8 @@ import (
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/v2"
+	"github.com/mattn/go-isatty"
+	"golang.org/x/term"
 
 	"github.com/pomdtr/smallweb/internal/app"
 	"github.com/pomdtr/smallweb/internal/build"
@@ -67,14 +70,30 @@ func (f fakeReadCloser) Close() error {
 	return nil
 }
 
+// localOnlyAnnotation marks commands which cannot be run from an ssh session.
+const localOnlyAnnotation = "smallweb.local-only"
+
+var loadEnvOnce sync.Once
+
 func NewCmdRoot() *cobra.Command {
-	_ = k.Load(envProvider, nil)
+	loadEnvOnce.Do(func() {
+		_ = k.Load(envProvider, nil)
+	})
 	rootCmd := &cobra.Command{
 		Use:           "smallweb",
 		Short:         "Host websites from your internet folder",
 		Version:       build.Version,
 		SilenceErrors: true,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// commands running inside the server share its configuration
+			if _, ok := handlerFromContext(cmd.Context()); ok {
+				if isLocalOnly(cmd) {
+					return fmt.Errorf("%s is not available over ssh", cmd.CommandPath())
+				}
+
+				return nil
+			}
+
 			flagProvider := posflag.Provider(cmd.Root().PersistentFlags(), ".", k)
 			_ = k.Load(confmap.Provider(map[string]interface{}{
 				"dir": findSmallwebDir(),
@@ -135,12 +154,11 @@ func NewCmdRoot() *cobra.Command {
 					command.Env = append(command.Env, fmt.Sprintf("SMALLWEB_DIR=%s", k.String("dir")))
 					command.Env = append(command.Env, fmt.Sprintf("SMALLWEB_DOMAIN=%s", k.String("domain")))
 
-					command.Stdin = os.Stdin
 					command.Stdout = cmd.OutOrStdout()
 					command.Stderr = cmd.ErrOrStderr()
 
 					cmd.SilenceErrors = true
-					return command.Run()
+					return runWithStdin(command, cmd.InOrStdin())
 				}
 			}
 
@@ -161,20 +179,17 @@ func NewCmdRoot() *cobra.Command {
 	rootCmd.AddCommand(NewCmdConfig())
 	rootCmd.AddCommand(NewCmdGitReceivePack())
 	rootCmd.AddCommand(NewCmdGitUploadPack())
-
-	if env, ok := os.LookupEnv("SMALLWEB_DISABLED_COMMANDS"); ok {
-		disabledCommands := strings.Split(env, ",")
-		for _, commandName := range disabledCommands {
-			if commandName == "completion" {
-				rootCmd.CompletionOptions.DisableDefaultCmd = true
-				continue // Skip disabling the completion command
-			}
-
-			if command, ok := GetCommand(rootCmd, commandName); ok {
-				rootCmd.RemoveCommand(command)
-			}
-		}
-	}
+	rootCmd.AddCommand(NewCmdGitDeploy())
+	rootCmd.AddCommand(NewCmdDeploy())
+	rootCmd.AddCommand(NewCmdRollback())
+	rootCmd.AddCommand(NewCmdExport())
+	rootCmd.AddCommand(NewCmdImport())
+	rootCmd.AddCommand(NewCmdBackup())
+	rootCmd.AddCommand(NewCmdDB())
+	rootCmd.AddCommand(NewCmdKV())
+	rootCmd.AddCommand(NewCmdCache())
+	rootCmd.AddCommand(NewCmdSandboxExec())
+	rootCmd.AddCommand(NewCmdLimitExec())
 
 	return rootCmd
 }
@@ -189,6 +204,49 @@ func GetCommand(cmd *cobra.Command, name string) (*cobra.Command, bool) {
 	return nil, false
 }
 
+// isLocalOnly reports whether cmd, or one of its parents, is unavailable from ssh sessions.
+func isLocalOnly(cmd *cobra.Command) bool {
+	for c := cmd; c != nil; c = c.Parent() {
+		if _, ok := c.Annotations[localOnlyAnnotation]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRemote reports whether a command runs in the server for an ssh session. Paths given by
+// the user would then resolve on the server, so files are streamed through stdio instead.
+func isRemote(cmd *cobra.Command) bool {
+	_, ok := handlerFromContext(cmd.Context())
+	return ok
+}
+
+// isTerminal reports whether w is connected to a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && isatty.IsTerminal(f.Fd())
+}
+
+func terminalWidth(w io.Writer) (int, error) {
+	f, ok := w.(*os.File)
+	if !ok {
+		return 0, fmt.Errorf("output is not a terminal")
+	}
+
+	width, _, err := term.GetSize(int(f.Fd()))
+	if err != nil {
+		return 0, err
+	}
+
+	// ssh clients without a controlling terminal report an empty window
+	if width == 0 {
+		return 80, nil
+	}
+
+	return width, nil
+}
+
 func isExecutable(path string) (bool, error) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
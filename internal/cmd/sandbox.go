@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"encoding/json"
+
+	"github.com/pomdtr/smallweb/internal/sandbox"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdSandboxExec() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                sandbox.ExecCommand + " <config> -- <command> [args...]",
+		Short:              "Run a command in the sandbox of an app",
+		Hidden:             true,
+		Annotations:        map[string]string{localOnlyAnnotation: ""},
+		DisableFlagParsing: true,
+		Args:               cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if args[1] != "--" {
+				cmd.PrintErrln("expected -- after the sandbox config")
+				return ExitError{1}
+			}
+
+			var conf sandbox.Config
+			if err := json.Unmarshal([]byte(args[0]), &conf); err != nil {
+				cmd.PrintErrf("failed to decode sandbox config: %v\n", err)
+				return ExitError{1}
+			}
+
+			// exec only returns on failure
+			if err := sandbox.Exec(conf, args[2:]); err != nil {
+				cmd.PrintErrf("failed to enter sandbox: %v\n", err)
+				return ExitError{1}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/creack/pty"
+	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/sftp"
+	"github.com/spf13/cobra"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// readOnlyOption is an authorized key option restricting the key to read-only sftp access,
+// e.g. "read-only ssh-ed25519 AAAA..."
+const readOnlyOption = "read-only"
+
+type permissionsContextKey struct{}
+
+// sshPermissions describes what an authenticated ssh key is allowed to do.
+type sshPermissions struct {
+	// Admin keys are listed in the global authorizedKeys and can access every app.
+	Admin bool
+	// App is the app the key was authorized for, when listed in apps.<app>.authorizedKeys.
+	App      string
+	ReadOnly bool
+}
+
+// CanRunCommands reports whether the key can run cli commands and open the dashboard.
+func (me sshPermissions) CanRunCommands() bool {
+	return me.Admin && !me.ReadOnly
+}
+
+// CanAccessApp reports whether the key is allowed to access the given app.
+func (me sshPermissions) CanAccessApp(appname string) bool {
+	return me.Admin || me.App == appname
+}
+
+func permissionsFromContext(ctx ssh.Context) sshPermissions {
+	perms, _ := ctx.Value(permissionsContextKey{}).(sshPermissions)
+	return perms
+}
+
+// PublicKeyHandler authorizes keys listed in the global config, as well as app keys
+// when the ssh user matches the app name. hostKey is always considered an admin key.
+func PublicKeyHandler(hostKey gossh.PublicKey) ssh.PublicKeyHandler {
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		if ssh.KeysEqual(hostKey, key) {
+			ctx.SetValue(permissionsContextKey{}, sshPermissions{Admin: true})
+			return true
+		}
+
+		if readOnly, ok := matchAuthorizedKey(k.Strings("authorizedKeys"), key); ok {
+			ctx.SetValue(permissionsContextKey{}, sshPermissions{Admin: true, ReadOnly: readOnly})
+			return true
+		}
+
+		appname := ctx.User()
+		if appname == "" || strings.ContainsAny(appname, `./\`) {
+			return false
+		}
+
+		if readOnly, ok := matchAuthorizedKey(k.Strings(fmt.Sprintf("apps.%s.authorizedKeys", appname)), key); ok {
+			ctx.SetValue(permissionsContextKey{}, sshPermissions{App: appname, ReadOnly: readOnly})
+			return true
+		}
+
+		return false
+	}
+}
+
+// matchAuthorizedKey looks for key in a list of authorized_keys lines and reports whether it is read-only.
+func matchAuthorizedKey(authorizedKeys []string, key ssh.PublicKey) (readOnly bool, ok bool) {
+	for _, authorizedKey := range authorizedKeys {
+		if authorizedKey == "*" {
+			return false, true
+		}
+
+		k, _, options, _, err := gossh.ParseAuthorizedKey([]byte(authorizedKey))
+		if err != nil {
+			continue
+		}
+
+		if !ssh.KeysEqual(k, key) {
+			continue
+		}
+
+		return slices.Contains(options, readOnlyOption), true
+	}
+
+	return false, false
+}
+
+// SFTPAuthorizer exposes the whole smallweb dir to admins connecting as _,
+// and the app dir to users connecting with the app name, without its config and releases.
+func SFTPAuthorizer(session ssh.Session) (sftp.Permissions, error) {
+	perms := permissionsFromContext(session.Context())
+
+	if session.User() == "_" {
+		if !perms.Admin {
+			return sftp.Permissions{}, fmt.Errorf("only admin keys can access the smallweb dir")
+		}
+
+		return sftp.Permissions{
+			Root:     k.String("dir"),
+			ReadOnly: perms.ReadOnly,
+		}, nil
+	}
+
+	if !perms.CanAccessApp(session.User()) {
+		return sftp.Permissions{}, fmt.Errorf("key is not authorized for app %s", session.User())
+	}
+
+	a, err := app.LoadApp(session.User(), k.String("dir"), k.String("domain"))
+	if err != nil {
+		return sftp.Permissions{}, fmt.Errorf("failed to load app %s: %w", session.User(), err)
+	}
+
+	sftpPerms := sftp.Permissions{
+		Root:     a.BaseDir,
+		ReadOnly: perms.ReadOnly,
+	}
+
+	// the config, the env and the releases of the app are managed by admins
+	if !perms.Admin {
+		sftpPerms.ReadOnlyPaths = []string{
+			"smallweb.json",
+			"smallweb.jsonc",
+			".env",
+			app.ReleasesDirName,
+			app.CurrentLinkName,
+		}
+	}
+
+	return sftpPerms, nil
+}
+
+type handlerContextKey struct{}
+
+// withHandler attaches the running server to the context of commands executed from ssh sessions.
+func withHandler(ctx context.Context, handler *Handler) context.Context {
+	return context.WithValue(ctx, handlerContextKey{}, handler)
+}
+
+func handlerFromContext(ctx context.Context) (*Handler, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+
+	handler, ok := ctx.Value(handlerContextKey{}).(*Handler)
+	return handler, ok
+}
+
+// CommandMiddleware runs the smallweb cli inside the server process, using the session stdio.
+// Interactive sessions without a command are passed to the next handler.
+func (me *Handler) CommandMiddleware(next ssh.Handler) ssh.Handler {
+	return func(sess ssh.Session) {
+		if !permissionsFromContext(sess.Context()).CanRunCommands() {
+			wish.Fatalln(sess, "this key is only allowed to use sftp")
+			return
+		}
+
+		if _, _, isPty := sess.Pty(); isPty && len(sess.Command()) == 0 {
+			next(sess)
+			return
+		}
+
+		sess.Exit(me.runCommand(sess))
+	}
+}
+
+func (me *Handler) runCommand(sess ssh.Session) int {
+	args := sess.Command()
+	if args == nil {
+		// cobra falls back to os.Args when args are nil
+		args = []string{}
+	}
+
+	root := NewCmdRoot()
+	root.CompletionOptions.DisableDefaultCmd = true
+	root.SetArgs(args)
+
+	ctx := withHandler(sess.Context(), me)
+
+	ptyReq, winCh, isPty := sess.Pty()
+	if !isPty {
+		root.SetIn(sess)
+		root.SetOut(sess)
+		root.SetErr(sess.Stderr())
+
+		return execute(ctx, root, sess.Stderr())
+	}
+
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		fmt.Fprintf(sess.Stderr(), "failed to allocate pty: %v\n", err)
+		return 1
+	}
+	defer ptmx.Close()
+
+	pty.Setsize(ptmx, &pty.Winsize{
+		Rows: uint16(ptyReq.Window.Height),
+		Cols: uint16(ptyReq.Window.Width),
+	})
+
+	go func() {
+		for win := range winCh {
+			pty.Setsize(ptmx, &pty.Winsize{
+				Rows: uint16(win.Height),
+				Cols: uint16(win.Width),
+			})
+		}
+	}()
+
+	go func() {
+		io.Copy(ptmx, sess)
+	}()
+
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		io.Copy(sess, ptmx)
+	}()
+
+	root.SetIn(tty)
+	root.SetOut(tty)
+	root.SetErr(tty)
+
+	code := execute(ctx, root, tty)
+
+	// closing the tty flushes the remaining output to the session
+	tty.Close()
+	<-outputDone
+
+	return code
+}
+
+// execute runs the command tree and returns the exit code, mirroring the main entrypoint.
+func execute(ctx context.Context, root *cobra.Command, stderr io.Writer) int {
+	if err := root.ExecuteContext(ctx); err != nil {
+		var exitErr ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.Code
+		}
+
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -2,20 +2,23 @@ package cmd
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	_ "embed"
 
@@ -23,8 +26,9 @@ import (
 	"github.com/charmbracelet/ssh"
 	"gopkg.in/natefinch/lumberjack.v2"
 
+	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/wish"
-	"github.com/creack/pty"
+	bm "github.com/charmbracelet/wish/bubbletea"
 	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/lmittmann/tint"
@@ -37,7 +41,13 @@ import (
 	"github.com/knadh/koanf/v2"
 
 	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/cache"
+	"github.com/pomdtr/smallweb/internal/compress"
+	"github.com/pomdtr/smallweb/internal/kv"
+	"github.com/pomdtr/smallweb/internal/logs"
+	"github.com/pomdtr/smallweb/internal/ratelimit"
 	"github.com/pomdtr/smallweb/internal/sftp"
+	"github.com/pomdtr/smallweb/internal/static"
 	"github.com/pomdtr/smallweb/internal/watcher"
 	gossh "golang.org/x/crypto/ssh"
 
@@ -59,13 +69,15 @@ func NewCmdUp() *cobra.Command {
 		tlsKey        string
 		logFormat     string
 		logOutput     string
+		sftpAuditLog  bool
 	}
 
 	cmd := &cobra.Command{
-		Use:     "up",
-		Short:   "Start the smallweb evaluation server",
-		Aliases: []string{"serve"},
-		Args:    cobra.NoArgs,
+		Use:         "up",
+		Annotations: map[string]string{localOnlyAnnotation: ""},
+		Short:       "Start the smallweb evaluation server",
+		Aliases:     []string{"serve"},
+		Args:        cobra.NoArgs,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if _, err := checkDenoVersion(); err != nil {
 				return err
@@ -105,6 +117,9 @@ func NewCmdUp() *cobra.Command {
 				}
 			}
 
+			logBuffer := logs.NewBuffer(1000)
+			logger = slog.New(logBuffer.Handler(logger.Handler()))
+
 			sysLogger := logger.With("logger", "system")
 
 			if k.String("dir") == "" {
@@ -117,9 +132,18 @@ func NewCmdUp() *cobra.Command {
 				return ExitError{1}
 			}
 
+			// requests to the git domain are served as repositories, the app would be unreachable
+			if appname, ok := gitDomainApp(); ok && utils.FileExists(filepath.Join(k.String("dir"), appname)) {
+				sysLogger.Error("app domain is used to serve repositories, rename the app or set gitDomain", "app", appname, "domain", gitDomain())
+				return ExitError{1}
+			}
+
 			handler := &Handler{
-				workers: make(map[string]*worker.Worker),
-				logger:  logger,
+				workers:  make(map[string]*worker.Worker),
+				statics:  make(map[string]*staticApp),
+				limiters: make(map[string]*appLimiter),
+				logger:   logger,
+				logs:     logBuffer,
 			}
 
 			watcher, err := watcher.NewWatcher(k.String("dir"), func() {
@@ -150,6 +174,46 @@ func NewCmdUp() *cobra.Command {
 			go watcher.Start()
 			defer watcher.Stop()
 
+			// budgets are read once, while cache.enabled is checked on each request
+			responseCache, err := cache.New(cache.Options{
+				Dir:       cacheDir(),
+				MaxMemory: cacheSize("cache.memory", 64),
+				MaxDisk:   cacheSize("cache.disk", 1024),
+				ModTime:   watcher.GetAppMtime,
+			})
+			if err != nil {
+				sysLogger.Error("failed to create cache", "error", err)
+				return ExitError{1}
+			}
+			defer responseCache.Close()
+			handler.cache = responseCache
+			go handler.reportRateLimits(logger.With("logger", "ratelimit"), time.Minute)
+
+			// apps reach their key-value store through a loopback listener, with a token signed by a per-process key
+			kvKey := make([]byte, 32)
+			if _, err := rand.Read(kvKey); err != nil {
+				sysLogger.Error("failed to generate kv key", "error", err)
+				return ExitError{1}
+			}
+
+			kvListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				sysLogger.Error("failed to listen for kv requests", "error", err)
+				return ExitError{1}
+			}
+			defer kvListener.Close()
+
+			kvHandler := kv.NewHandler(kvKey, func(appname string) (string, error) {
+				a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
+				if err != nil {
+					return "", err
+				}
+
+				return a.KVPath(), nil
+			}, logger.With("logger", "kv"))
+			go http.Serve(kvListener, kvHandler)
+			kv.Configure(fmt.Sprintf("http://%s", kvListener.Addr()), kvKey)
+
 			logMiddleware := sloghttp.NewWithConfig(logger.With("logger", "http"), sloghttp.Config{
 				WithRequestID: false,
 			})
@@ -181,7 +245,7 @@ func NewCmdUp() *cobra.Command {
 				certmagic.Default.Logger = zap.NewNop()
 				certmagic.Default.OnDemand = &certmagic.OnDemandConfig{
 					DecisionFunc: func(ctx context.Context, name string) error {
-						if _, _, ok := lookupApp(name); ok {
+						if _, _, ok := lookupApp(name); ok || name == gitDomain() {
 							return nil
 						}
 
@@ -202,8 +266,14 @@ func NewCmdUp() *cobra.Command {
 					return ExitError{1}
 				}
 
+				// proxies in front of smallweb may speak cleartext http/2, e.g. to forward grpc requests
+				var protocols http.Protocols
+				protocols.SetHTTP1(true)
+				protocols.SetUnencryptedHTTP2(true)
+				server := &http.Server{Handler: logMiddleware(handler), Protocols: &protocols}
+
 				logger.Info("serving http", "domain", k.String("domain"), "dir", k.String("dir"), "addr", addr)
-				go http.Serve(ln, logMiddleware(handler))
+				go server.Serve(ln)
 			}
 
 			if flags.enableCrons {
@@ -213,6 +283,19 @@ func NewCmdUp() *cobra.Command {
 				defer crons.Stop()
 			}
 
+			if schedule := k.String("backup.schedule"); schedule != "" {
+				backupLogger := logger.With("logger", "backup")
+				backups, err := BackupRunner(schedule, backupLogger)
+				if err != nil {
+					sysLogger.Error("failed to schedule backups", "error", err)
+					return ExitError{1}
+				}
+
+				logger.Info("scheduling backups", "schedule", schedule)
+				backups.Start()
+				defer backups.Stop()
+			}
+
 			if flags.smtpAddr != "" {
 				handler := func(remoteAddr net.Addr, from string, to []string, data []byte) error {
 					for _, recipient := range to {
@@ -234,7 +317,7 @@ func NewCmdUp() *cobra.Command {
 							continue
 						}
 
-						worker := worker.NewWorker(a, nil)
+						worker := newWorker(a, nil)
 						if err := worker.SendEmail(context.Background(), data); err != nil {
 							logger.Error("failed to send email", "error", err)
 							continue
@@ -292,117 +375,30 @@ func NewCmdUp() *cobra.Command {
 					return ExitError{1}
 				}
 
-				authorizedKey := string(gossh.MarshalAuthorizedKey(signer.PublicKey()))
 				sshLogger := logger.With("logger", "ssh")
+				sftpLogger := logger.With("logger", "sftp")
+				if flags.sftpAuditLog {
+					auditLog := &lumberjack.Logger{
+						Filename:   filepath.Join(k.String("dir"), ".smallweb", "sftp-audit.log"),
+						MaxSize:    10, // megabytes
+						MaxBackups: 3,
+					}
+					defer auditLog.Close()
+
+					sftpLogger = slog.New(logs.Tee(sftpLogger.Handler(), slog.NewJSONHandler(auditLog, &slog.HandlerOptions{})))
+				}
+
 				srv, err := wish.NewServer(
 					wish.WithAddress(flags.sshAddr),
 					wish.WithHostKeyPath(sshPrivateKeyPath),
-					wish.WithPublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
-						authorizedKeys := []string{authorizedKey}
-						authorizedKeys = append(authorizedKeys, k.Strings("authorizedKeys")...)
-
-						for _, authorizedKey := range authorizedKeys {
-							if authorizedKey == "*" {
-								return true
-							}
-
-							k, _, _, _, err := gossh.ParseAuthorizedKey([]byte(authorizedKey))
-							if err != nil {
-								continue
-							}
-
-							if ssh.KeysEqual(k, key) {
-								return true
-							}
-						}
-
-						return false
-					}),
-					sftp.SSHOption(k.String("dir"), nil),
+					wish.WithPublicKeyAuth(PublicKeyHandler(signer.PublicKey())),
+					sftp.SSHOption(SFTPAuthorizer, sftpLogger),
+					PortForwardingOption(handler, sshLogger),
 					wish.WithMiddleware(
-						func(next ssh.Handler) ssh.Handler {
-							return func(sess ssh.Session) {
-								execPath, err := os.Executable()
-								if err != nil {
-									fmt.Fprintf(sess.Stderr(), "failed to get executable path: %v\n", err)
-									sess.Exit(1)
-									return
-								}
-
-								cmd := exec.Command(execPath, "--dir", k.String("dir"), "--domain", k.String("domain"))
-								cmd.Args = append(cmd.Args, sess.Command()...)
-								cmd.Env = os.Environ()
-
-								cmd.Env = append(cmd.Env, "SMALLWEB_DISABLED_COMMANDS=up,config,init,doctor,completion")
-
-								ptyReq, winCh, isPty := sess.Pty()
-								if isPty {
-									cmd.Env = append(cmd.Env, "TERM="+ptyReq.Term)
-									f, err := pty.Start(cmd)
-									if err != nil {
-										fmt.Fprintf(sess, "failed to start command: %v\n", err)
-										sess.Exit(1)
-									}
-
-									go func() {
-										for win := range winCh {
-											pty.Setsize(f, &pty.Winsize{
-												Rows: uint16(win.Height),
-												Cols: uint16(win.Width),
-											})
-										}
-									}()
-
-									go func() {
-										io.Copy(sess, f)
-									}()
-
-									go func() {
-										io.Copy(f, sess)
-									}()
-
-									if err := cmd.Wait(); err != nil {
-										var exitErr *exec.ExitError
-										if errors.As(err, &exitErr) {
-											sess.Exit(exitErr.ExitCode())
-											return
-										}
-
-										fmt.Fprintf(sess, "failed to run command: %v", err)
-										sess.Exit(1)
-										return
-									}
-
-									return
-								}
-
-								cmd.Stdout = sess
-								cmd.Stderr = sess.Stderr()
-								stdin, err := cmd.StdinPipe()
-								if err != nil {
-									fmt.Fprintf(sess, "failed to get stdin: %v\n", err)
-									sess.Exit(1)
-									return
-								}
-
-								go func() {
-									defer stdin.Close()
-									io.Copy(stdin, sess)
-								}()
-
-								if err := cmd.Run(); err != nil {
-									var exitErr *exec.ExitError
-									if errors.As(err, &exitErr) {
-										sess.Exit(exitErr.ExitCode())
-										return
-									}
-
-									fmt.Fprintf(sess, "failed to run command: %v", err)
-									sess.Exit(1)
-									return
-								}
-							}
-						},
+						bm.Middleware(func(sess ssh.Session) (tea.Model, []tea.ProgramOption) {
+							return NewDashboard(handler, bm.MakeRenderer(sess)), []tea.ProgramOption{tea.WithAltScreen()}
+						}),
+						handler.CommandMiddleware,
 						func(next ssh.Handler) ssh.Handler {
 							return func(sess ssh.Session) {
 								sshLogger.Info(
@@ -446,6 +442,7 @@ func NewCmdUp() *cobra.Command {
 	cmd.Flags().StringVar(&flags.logFormat, "log-format", "", "log format (json, text or pretty)")
 	cmd.Flags().StringVar(&flags.logOutput, "log-output", "stderr", "log output (stdout, stderr or filepath)")
 	cmd.Flags().BoolVar(&flags.enableCrons, "enable-crons", false, "enable cron jobs")
+	cmd.Flags().BoolVar(&flags.sftpAuditLog, "sftp-audit-log", false, "append sftp file changes to .smallweb/sftp-audit.log")
 
 	cmd.MarkFlagsMutuallyExclusive("on-demand-tls", "tls-cert")
 	cmd.MarkFlagsMutuallyExclusive("on-demand-tls", "tls-key")
@@ -484,8 +481,26 @@ func getListener(addr string, config *tls.Config) (net.Listener, error) {
 type Handler struct {
 	watcher  *watcher.Watcher
 	logger   *slog.Logger
+	logs     *logs.Buffer
 	workerMu sync.Mutex
 	workers  map[string]*worker.Worker
+	statics  map[string]*staticApp
+	cache    *cache.Cache
+
+	limiterMu sync.Mutex
+	limiters  map[string]*appLimiter
+}
+
+// appLimiter holds the rate limits of an app, nil if it has none.
+type appLimiter struct {
+	limiter  *ratelimit.Limiter
+	loadedAt time.Time
+}
+
+// staticApp serves the files of an app without entrypoint, without starting a worker.
+type staticApp struct {
+	handler  http.Handler
+	loadedAt time.Time
 }
 
 func (me *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -494,6 +509,11 @@ func (me *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		hostname = r.Host
 	}
 
+	if hostname == gitDomain() {
+		me.serveGit(w, r)
+		return
+	}
+
 	appname, redirect, ok := lookupApp(hostname)
 	if !ok {
 		w.WriteHeader(http.StatusNotFound)
@@ -510,6 +530,45 @@ func (me *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	me.serveApp(w, r, appname)
+}
+
+func (me *Handler) serveApp(w http.ResponseWriter, r *http.Request, appname string) {
+	// rejected requests never reach the worker, nor the cache
+	if limiter := me.rateLimiter(appname); limiter != nil {
+		if ok, retryAfter := limiter.Allow(clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if files, ok, err := me.staticHandler(appname); err != nil {
+		if errors.Is(err, app.ErrAppNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("No app found for host %s", r.Host)))
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load app: %v", err)
+		return
+	} else if ok {
+		files.ServeHTTP(w, r)
+		return
+	}
+
+	if me.cache != nil && k.Bool("cache.enabled") {
+		me.cache.Serve(w, r, appname, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			me.serveWorker(w, r, appname)
+		}))
+		return
+	}
+
+	me.serveWorker(w, r, appname)
+}
+
+func (me *Handler) serveWorker(w http.ResponseWriter, r *http.Request, appname string) {
 	wk, err := me.GetWorker(appname, k.String("dir"), k.String("domain"))
 	if err != nil {
 		if errors.Is(err, app.ErrAppNotFound) {
@@ -566,6 +625,36 @@ func ExtractScheme(r *http.Request) string {
 	return "http"
 }
 
+// newWorker creates a worker for an app. The resource limits set in the global config are ceilings, as the
+// config of the app is writable by the app, while the request limits are defaults.
+func newWorker(a app.App, logger *slog.Logger) *worker.Worker {
+	wk := worker.NewWorker(a, logger)
+	wk.Limits = a.Config.Limits.Within(globalLimits(fmt.Sprintf("apps.%s.limits", a.Name)).Merge(globalLimits("limits")))
+	wk.Requests = a.Config.Requests.Merge(app.Requests{
+		Timeout:       k.Int("requests.timeout"),
+		HeaderTimeout: k.Int("requests.headerTimeout"),
+		MaxBodySize:   k.Int("requests.maxBodySize"),
+	})
+
+	// the sandbox is set by the admin, as the config of the app could opt out of it
+	wk.Sandbox = k.Bool("sandbox")
+	if key := fmt.Sprintf("apps.%s.sandbox", a.Name); k.Exists(key) {
+		wk.Sandbox = k.Bool(key)
+	}
+
+	return wk
+}
+
+// globalLimits reads resource limits from the global config.
+func globalLimits(key string) app.Limits {
+	return app.Limits{
+		Memory:    k.Int(key + ".memory"),
+		CPU:       k.Float64(key + ".cpu"),
+		Files:     k.Int(key + ".files"),
+		Processes: k.Int(key + ".processes"),
+	}
+}
+
 func (me *Handler) GetWorker(appname string, rootDir, domain string) (*worker.Worker, error) {
 	if wk, ok := me.workers[appname]; ok && wk.IsRunning() && me.watcher.GetAppMtime(appname).Before(wk.StartedAt) {
 		return wk, nil
@@ -579,7 +668,7 @@ func (me *Handler) GetWorker(appname string, rootDir, domain string) (*worker.Wo
 		return nil, fmt.Errorf("failed to load app: %w", err)
 	}
 
-	wk := worker.NewWorker(a, me.logger.With("logger", "console", "app", appname))
+	wk := newWorker(a, me.logger.With("logger", "console", "app", appname))
 	if err := wk.StartServer(); err != nil {
 		return nil, fmt.Errorf("failed to start worker: %w", err)
 	}
@@ -587,3 +676,157 @@ func (me *Handler) GetWorker(appname string, rootDir, domain string) (*worker.Wo
 	me.workers[a.Name] = wk
 	return wk, nil
 }
+
+// staticHandler returns the file server of an app, or false if the app has an entrypoint.
+func (me *Handler) staticHandler(appname string) (http.Handler, bool, error) {
+	me.workerMu.Lock()
+	defer me.workerMu.Unlock()
+
+	mtime := me.watcher.GetAppMtime(appname)
+	if sa, ok := me.statics[appname]; ok && mtime.Before(sa.loadedAt) {
+		return sa.handler, true, nil
+	}
+
+	if wk, ok := me.workers[appname]; ok && wk.IsRunning() && mtime.Before(wk.StartedAt) {
+		return nil, false, nil
+	}
+
+	delete(me.statics, appname)
+	a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !a.IsStatic() {
+		return nil, false, nil
+	}
+
+	// the data dir is private, even when the files are served from the root of the app
+	var private []string
+	if a.Dir() == a.SourceDir() {
+		private = append(private, "data")
+	}
+
+	var handler http.Handler = static.NewHandler(a.Dir(), static.Options{
+		Private: private,
+		SPA:     a.Config.Static.SPA,
+		Listing: a.Config.Static.Listing,
+	})
+
+	// precompressed files are served as is
+	if compression := a.Config.Compression; !compression.Disabled {
+		handler = compress.Handler(handler, compress.Options{
+			Encodings: compression.Encodings,
+			MinSize:   compression.MinSize,
+		})
+	}
+	me.statics[appname] = &staticApp{handler: handler, loadedAt: time.Now()}
+
+	return handler, true, nil
+}
+
+// rateLimiter returns the rate limiter of an app, or nil if its requests are not limited.
+// Buckets are reset when the app changes.
+func (me *Handler) rateLimiter(appname string) *ratelimit.Limiter {
+	me.limiterMu.Lock()
+	defer me.limiterMu.Unlock()
+
+	if al, ok := me.limiters[appname]; ok && me.watcher.GetAppMtime(appname).Before(al.loadedAt) {
+		return al.limiter
+	}
+
+	a, err := app.LoadApp(appname, k.String("dir"), k.String("domain"))
+	if err != nil {
+		// the error is reported when serving the app
+		return nil
+	}
+
+	al := &appLimiter{loadedAt: time.Now()}
+	if conf := a.Config.RateLimit; conf.App.Rate > 0 || conf.Client.Rate > 0 {
+		al.limiter = ratelimit.New(
+			ratelimit.Limit{Rate: conf.App.Rate, Burst: conf.App.Burst},
+			ratelimit.Limit{Rate: conf.Client.Rate, Burst: conf.Client.Burst},
+		)
+	}
+	me.limiters[appname] = al
+
+	return al.limiter
+}
+
+// reportRateLimits periodically logs the requests allowed and rejected by the rate limits of each app.
+func (me *Handler) reportRateLimits(logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		me.limiterMu.Lock()
+		limiters := make(map[string]*ratelimit.Limiter, len(me.limiters))
+		for appname, al := range me.limiters {
+			if al.limiter != nil {
+				limiters[appname] = al.limiter
+			}
+		}
+		me.limiterMu.Unlock()
+
+		for appname, limiter := range limiters {
+			allowed, rejected, clients := limiter.Counters()
+			if allowed == 0 && rejected == 0 {
+				continue
+			}
+
+			if rejected > 0 {
+				logger.Warn("rate limited requests", "app", appname, "allowed", allowed, "rejected", rejected, "clients", clients)
+			} else {
+				logger.Info("rate limited requests", "app", appname, "allowed", allowed, "rejected", rejected, "clients", clients)
+			}
+		}
+	}
+}
+
+// clientIP returns the address of the client of a request. Requests relayed by a proxy on the
+// same host, e.g. caddy, are attributed to the last address of X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			parts := strings.Split(forwarded[len(forwarded)-1], ",")
+			if last := strings.TrimSpace(parts[len(parts)-1]); last != "" {
+				return last
+			}
+		}
+	}
+
+	return host
+}
+
+// Worker returns the running worker of an app, if any.
+func (me *Handler) Worker(appname string) (*worker.Worker, bool) {
+	me.workerMu.Lock()
+	defer me.workerMu.Unlock()
+
+	wk, ok := me.workers[appname]
+	if !ok || !wk.IsRunning() {
+		return nil, false
+	}
+
+	return wk, true
+}
+
+// RestartWorker stops the running worker of an app and starts a fresh one.
+func (me *Handler) RestartWorker(appname string) error {
+	me.workerMu.Lock()
+	if wk, ok := me.workers[appname]; ok {
+		delete(me.workers, appname)
+		if err := wk.Stop(); err != nil {
+			me.logger.Warn("failed to stop worker", "app", appname, "error", err)
+		}
+	}
+	me.workerMu.Unlock()
+
+	_, err := me.GetWorker(appname, k.String("dir"), k.String("domain"))
+	return err
+}
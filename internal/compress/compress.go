@@ -0,0 +1,243 @@
+// Package compress encodes the responses of apps with the best encoding supported by the client.
+package compress
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultEncodings are the supported encodings, by order of preference.
+var DefaultEncodings = []string{"zstd", "br", "gzip"}
+
+// DefaultMinSize is the size in bytes under which responses are sent as is, as compression would not pay off.
+const DefaultMinSize = 1024
+
+// Options configures the compression of responses.
+type Options struct {
+	// Encodings restricts the encodings used, by order of preference.
+	Encodings []string
+	// MinSize is the Content-Length under which responses are not compressed.
+	MinSize int
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoders are reused across responses, as their buffers are costly to allocate.
+var encoders = map[string]*sync.Pool{
+	"zstd": {New: func() any {
+		// browsers only decode windows up to 8MiB
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<22))
+		return enc
+	}},
+	"br": {New: func() any {
+		// dynamic responses favor speed over ratio
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"gzip": {New: func() any {
+		enc, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return enc
+	}},
+}
+
+// Handler compresses the responses of next.
+func Handler(next http.Handler, opts Options) http.Handler {
+	encodings := DefaultEncodings
+	if len(opts.Encodings) > 0 {
+		encodings = slices.DeleteFunc(slices.Clone(opts.Encodings), func(encoding string) bool {
+			_, ok := encoders[encoding]
+			return !ok
+		})
+	}
+
+	minSize := opts.MinSize
+	if minSize <= 0 {
+		minSize = DefaultMinSize
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// upgraded connections are not http responses, and ranges apply to the identity encoding
+		if r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &responseWriter{
+			ResponseWriter: w,
+			encoding:       negotiate(r, encodings),
+			minSize:        minSize,
+		}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiate returns the encoding with the highest weight in Accept-Encoding, using our
+// preference to break ties, or an empty string if none is accepted.
+func negotiate(r *http.Request, encodings []string) string {
+	weights := make(map[string]float64)
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for part := range strings.SplitSeq(value, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			weight := 1.0
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if w, err := strconv.ParseFloat(q, 64); err == nil {
+					weight = w
+				}
+			}
+
+			weights[strings.ToLower(strings.TrimSpace(name))] = weight
+		}
+	}
+
+	var best string
+	var bestWeight float64
+	for _, encoding := range encodings {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+
+		if ok && weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+
+	return best
+}
+
+// compressible reports whether a content type benefits from compression. Images, videos and
+// archives are already compressed, and event streams must reach the client as they are written.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if mediaType == "text/event-stream" {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm",
+		"application/manifest+json", "application/x-ndjson", "image/svg+xml",
+		"font/ttf", "font/otf", "application/vnd.ms-fontobject":
+		return true
+	}
+
+	return false
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	minSize     int
+	wroteHeader bool
+	encoder     encoder
+}
+
+func (me *responseWriter) WriteHeader(code int) {
+	if me.wroteHeader {
+		return
+	}
+
+	// informational responses precede the final one
+	if code >= 100 && code < 200 {
+		me.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	me.wroteHeader = true
+	header := me.ResponseWriter.Header()
+	if header.Get("Content-Encoding") != "" || !compressible(header.Get("Content-Type")) {
+		me.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	// the response depends on Accept-Encoding, even when sent as is
+	if !slices.ContainsFunc(header.Values("Vary"), func(vary string) bool {
+		return strings.Contains(strings.ToLower(vary), "accept-encoding") || strings.TrimSpace(vary) == "*"
+	}) {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if me.encoding == "" || code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		me.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		me.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if contentLength, err := strconv.Atoi(header.Get("Content-Length")); err == nil && contentLength < me.minSize {
+		me.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", me.encoding)
+
+	// the encoded bytes differ, strong validators must not match those of the identity encoding
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	me.encoder = encoders[me.encoding].Get().(encoder)
+	me.encoder.Reset(me.ResponseWriter)
+	me.ResponseWriter.WriteHeader(code)
+}
+
+func (me *responseWriter) Write(p []byte) (int, error) {
+	if !me.wroteHeader {
+		me.WriteHeader(http.StatusOK)
+	}
+
+	if me.encoder != nil {
+		return me.encoder.Write(p)
+	}
+
+	return me.ResponseWriter.Write(p)
+}
+
+func (me *responseWriter) Flush() {
+	if me.encoder != nil {
+		_ = me.encoder.Flush()
+	}
+
+	_ = http.NewResponseController(me.ResponseWriter).Flush()
+}
+
+func (me *responseWriter) Unwrap() http.ResponseWriter {
+	return me.ResponseWriter
+}
+
+func (me *responseWriter) close() {
+	if me.encoder == nil {
+		return
+	}
+
+	_ = me.encoder.Close()
+	me.encoder.Reset(io.Discard)
+	encoders[me.encoding].Put(me.encoder)
+	me.encoder = nil
+}
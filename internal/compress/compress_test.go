@@ -0,0 +1,215 @@
+package compress
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiate(t *testing.T) {
+	for acceptEncoding, expected := range map[string]string{
+		"":                           "",
+		"identity":                   "",
+		"gzip":                       "gzip",
+		"gzip, deflate, br":          "br",
+		"gzip, deflate, br, zstd":    "zstd",
+		"GZIP":                       "gzip",
+		"br;q=0.5, gzip;q=0.8":       "gzip",
+		"zstd;q=0, br":               "br",
+		"*":                          "zstd",
+		"*;q=0.1, gzip;q=0.5":        "gzip",
+		"*, zstd;q=0":                "br",
+		"br;q=invalid":               "br",
+		"gzip;q=0, br;q=0, zstd;q=0": "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		if encoding := negotiate(r, DefaultEncodings); encoding != expected {
+			t.Errorf("%q: expected %q, got %q", acceptEncoding, expected, encoding)
+		}
+	}
+
+	// the encodings of the app take precedence over the preference of the client
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "zstd, br, gzip")
+	if encoding := negotiate(r, []string{"gzip", "br"}); encoding != "gzip" {
+		t.Errorf("expected gzip, got %q", encoding)
+	}
+}
+
+var body = strings.Repeat("smallweb compresses responses. ", 100)
+
+// serve sends a request through the handler, to an app answering with the given headers and body.
+func serve(opts Options, r *http.Request, status int, header map[string]string, content string) *httptest.ResponseRecorder {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range header {
+			w.Header().Set(name, value)
+		}
+
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, content)
+	}), opts)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func request(acceptEncoding string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	return r
+}
+
+func decode(t *testing.T, encoding string, r io.Reader) string {
+	t.Helper()
+
+	var decoded io.Reader
+	switch encoding {
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		decoded = dec
+	case "br":
+		decoded = brotli.NewReader(r)
+	case "gzip":
+		dec, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = dec
+	default:
+		decoded = r
+	}
+
+	content, err := io.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestEncodings(t *testing.T) {
+	for _, encoding := range DefaultEncodings {
+		t.Run(encoding, func(t *testing.T) {
+			// the pooled encoders must be reset between responses
+			for range 2 {
+				w := serve(Options{}, request(encoding), http.StatusOK, map[string]string{
+					"Content-Type":   "text/html; charset=utf-8",
+					"Content-Length": strconv.Itoa(len(body)),
+					"ETag":           `"v1"`,
+				}, body)
+
+				if contentEncoding := w.Header().Get("Content-Encoding"); contentEncoding != encoding {
+					t.Fatalf("expected %s, got %q", encoding, contentEncoding)
+				}
+
+				if w.Header().Get("Content-Length") != "" {
+					t.Errorf("expected the content length of the identity encoding to be dropped")
+				}
+
+				if etag := w.Header().Get("ETag"); etag != `W/"v1"` {
+					t.Errorf("expected a weak etag, got %s", etag)
+				}
+
+				if !slices.Contains(w.Header().Values("Vary"), "Accept-Encoding") {
+					t.Errorf("expected the response to vary on Accept-Encoding, got %v", w.Header().Values("Vary"))
+				}
+
+				if w.Body.Len() >= len(body) {
+					t.Errorf("expected the body to be compressed, got %d bytes", w.Body.Len())
+				}
+
+				if decoded := decode(t, encoding, w.Body); decoded != body {
+					t.Fatalf("expected the body to round-trip, got %q", decoded)
+				}
+			}
+		})
+	}
+}
+
+func TestUncompressedResponses(t *testing.T) {
+	html := map[string]string{"Content-Type": "text/html"}
+	for name, tc := range map[string]struct {
+		opts    Options
+		request *http.Request
+		status  int
+		header  map[string]string
+		vary    bool
+	}{
+		"not accepted":     {Options{}, request("identity"), http.StatusOK, html, true},
+		"not enabled":      {Options{Encodings: []string{"gzip"}}, request("br"), http.StatusOK, html, true},
+		"unknown encoding": {Options{Encodings: []string{"deflate"}}, request("deflate"), http.StatusOK, html, true},
+		"image":            {Options{}, request("gzip"), http.StatusOK, map[string]string{"Content-Type": "image/png"}, false},
+		"no content type":  {Options{}, request("gzip"), http.StatusOK, nil, false},
+		"event stream":     {Options{}, request("gzip"), http.StatusOK, map[string]string{"Content-Type": "text/event-stream"}, false},
+		"already encoded":  {Options{}, request("gzip"), http.StatusOK, map[string]string{"Content-Type": "text/html", "Content-Encoding": "br"}, false},
+		"no-transform":     {Options{}, request("gzip"), http.StatusOK, map[string]string{"Content-Type": "text/html", "Cache-Control": "public, no-transform"}, true},
+		"small":            {Options{}, request("gzip"), http.StatusOK, map[string]string{"Content-Type": "text/html", "Content-Length": "512"}, true},
+		"not modified":     {Options{}, request("gzip"), http.StatusNotModified, html, true},
+		"range": {Options{}, func() *http.Request {
+			r := request("gzip")
+			r.Header.Set("Range", "bytes=0-10")
+			return r
+		}(), http.StatusOK, html, false},
+		"head": {Options{}, func() *http.Request {
+			r := request("gzip")
+			r.Method = http.MethodHead
+			return r
+		}(), http.StatusOK, html, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			content := body
+			if tc.status == http.StatusNotModified {
+				content = ""
+			}
+
+			w := serve(tc.opts, tc.request, tc.status, tc.header, content)
+			if contentEncoding := w.Header().Get("Content-Encoding"); contentEncoding != tc.header["Content-Encoding"] {
+				t.Fatalf("expected the response to be sent as is, got %s", contentEncoding)
+			}
+
+			if w.Body.String() != content {
+				t.Fatalf("expected the body to be sent as is, got %d bytes", w.Body.Len())
+			}
+
+			if vary := slices.Contains(w.Header().Values("Vary"), "Accept-Encoding"); vary != tc.vary {
+				t.Fatalf("expected vary on Accept-Encoding to be %v, got %v", tc.vary, w.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+func TestMinSize(t *testing.T) {
+	header := map[string]string{"Content-Type": "application/json", "Content-Length": "100"}
+	if w := serve(Options{MinSize: 50}, request("gzip"), http.StatusOK, header, strings.Repeat("a", 100)); w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected responses above the min size to be compressed")
+	}
+
+	// responses of unknown size are compressed
+	if w := serve(Options{}, request("gzip"), http.StatusOK, map[string]string{"Content-Type": "text/plain"}, "short"); w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected responses without a content length to be compressed")
+	}
+}
+
+func TestVaryIsNotDuplicated(t *testing.T) {
+	w := serve(Options{}, request("gzip"), http.StatusOK, map[string]string{"Content-Type": "text/html", "Vary": "accept-encoding"}, body)
+	if vary := w.Header().Values("Vary"); len(vary) != 1 {
+		t.Fatalf("expected a single vary header, got %v", vary)
+	}
+}
@@ -0,0 +1,141 @@
+// Package database manages the SQLite databases stored in app data dirs.
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	_ "modernc.org/sqlite"
+)
+
+// header is the magic string starting every SQLite database file.
+var header = []byte("SQLite format 3\x00")
+
+// Open opens a SQLite database, creating it in WAL mode if it does not exist yet. When running
+// as root, the database files belong to the owner of their dir.
+func Open(path string) (*sql.DB, error) {
+	exists := true
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		exists = false
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// apps may access the database concurrently
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)", url.PathEscape(path)))
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not enable wal mode: %w", err)
+		}
+	}
+
+	if err := inheritOwner(db, path); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not set the owner of the database: %w", err)
+	}
+
+	return db, nil
+}
+
+// IsDatabase reports whether the file at path is a SQLite database.
+func IsDatabase(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false
+	}
+
+	return bytes.Equal(buf, header)
+}
+
+// Snapshot writes a consistent copy of a live database to dest, without blocking its writers.
+func Snapshot(ctx context.Context, path string, dest string) error {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro&_pragma=busy_timeout(5000)", url.PathEscape(path)))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", dest); err != nil {
+		return fmt.Errorf("could not snapshot %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Result holds the rows returned by a statement.
+type Result struct {
+	Columns []string
+	Rows    [][]any
+}
+
+// Query runs a statement, and returns the rows it produced, if any.
+func Query(ctx context.Context, db *sql.DB, query string, args ...any) (Result, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return Result{}, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Columns: columns, Rows: [][]any{}}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return Result{}, err
+		}
+
+		// text stored as blobs is more useful as a string
+		for i, value := range values {
+			if b, ok := value.([]byte); ok && utf8.Valid(b) {
+				values[i] = string(b)
+			}
+		}
+
+		result.Rows = append(result.Rows, values)
+	}
+
+	return result, rows.Err()
+}
+
+// Records returns the rows of a result as objects keyed by column name.
+func (me Result) Records() []map[string]any {
+	records := make([]map[string]any, 0, len(me.Rows))
+	for _, row := range me.Rows {
+		record := make(map[string]any, len(me.Columns))
+		for i, column := range me.Columns {
+			record[column] = row[i]
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inheritOwner gives the files of a database opened by root to the owner of its dir, e.g. the user of a
+// sandboxed app, so that smallweb commands never leave files the app cannot write to. SQLite creates the
+// wal and shm files on first access, so they are opened first, and kept while the db has open connections.
+func inheritOwner(db *sql.DB, path string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Uid == 0 {
+		return nil
+	}
+
+	if _, err := db.Exec("PRAGMA schema_version"); err != nil {
+		return err
+	}
+
+	for _, name := range []string{path, path + "-wal", path + "-shm"} {
+		if err := os.Lchown(name, int(stat.Uid), int(stat.Gid)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
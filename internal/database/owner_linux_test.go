@@ -0,0 +1,47 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestOpenInheritsOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the owner of databases is only set when running as root")
+	}
+
+	// e.g. the data dir of a sandboxed app
+	dataDir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const uid = 200999
+	if err := os.Chown(dataDir, uid, uid); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dataDir, "smallweb.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE TABLE items (name TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + "-wal", path + "-shm"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stat := info.Sys().(*syscall.Stat_t); stat.Uid != uid || stat.Gid != uid {
+			t.Errorf("expected %s to belong to %d, got %d:%d", filepath.Base(name), uid, stat.Uid, stat.Gid)
+		}
+	}
+}
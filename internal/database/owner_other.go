@@ -0,0 +1,10 @@
+//go:build !linux
+
+package database
+
+import "database/sql"
+
+// inheritOwner is a no-op, as apps are only sandboxed on linux.
+func inheritOwner(db *sql.DB, path string) error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package kv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxValueSize is the maximum size of a value written through the http api.
+const maxValueSize = 1 << 20
+
+var (
+	mu        sync.Mutex
+	serverURL string
+	secret    []byte
+)
+
+// Configure records where the kv server of this process listens, and the secret used to sign app tokens.
+func Configure(url string, key []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	serverURL = url
+	secret = key
+}
+
+// Env returns the variables giving an app access to its store, or nil if no kv server is running.
+func Env(appname string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if serverURL == "" {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("SMALLWEB_KV_URL=%s", serverURL),
+		fmt.Sprintf("SMALLWEB_KV_TOKEN=%s", token(secret, appname)),
+	}
+}
+
+// token identifies an app, and is signed so that apps cannot access each other stores.
+func token(key []byte, appname string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(appname))
+	return fmt.Sprintf("%s.%s", appname, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func verifyToken(key []byte, value string) (string, bool) {
+	// app names may contain dots, signatures never do
+	i := strings.LastIndex(value, ".")
+	if i <= 0 {
+		return "", false
+	}
+
+	appname := value[:i]
+
+	return appname, hmac.Equal([]byte(value), []byte(token(key, appname)))
+}
+
+// Handler serves the stores of all apps:
+//
+//	GET    /?prefix=<prefix>  list keys as a json array
+//	GET    /<key>             read a value
+//	PUT    /<key>             write the request body as the value
+//	DELETE /<key>             delete a value
+type Handler struct {
+	key       []byte
+	storePath func(appname string) (string, error)
+	logger    *slog.Logger
+}
+
+// NewHandler creates a kv handler. storePath resolves the database file of an app.
+func NewHandler(key []byte, storePath func(appname string) (string, error), logger *slog.Logger) *Handler {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+
+	return &Handler{
+		key:       key,
+		storePath: storePath,
+		logger:    logger,
+	}
+}
+
+func (me *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return
+	}
+
+	appname, ok := verifyToken(me.key, bearer)
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// stores are opened for each request, as data dirs may be swapped when restoring a backup
+	path, err := me.storePath(appname)
+	if err != nil {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+
+	store, err := Open(path)
+	if err != nil {
+		me.logger.Error("failed to open store", "app", appname, "error", err)
+		http.Error(w, "failed to open store", http.StatusInternalServerError)
+		return
+	}
+	defer store.Close()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		keys, err := store.List(r.Context(), r.URL.Query().Get("prefix"))
+		if err != nil {
+			me.logger.Error("failed to list keys", "app", appname, "error", err)
+			http.Error(w, "failed to list keys", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value, err := store.Get(r.Context(), key)
+		if errors.Is(err, ErrKeyNotFound) {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			me.logger.Error("failed to read key", "app", appname, "key", key, "error", err)
+			http.Error(w, "failed to read key", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(len(value)))
+		w.Write(value)
+	case http.MethodPut:
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			http.Error(w, "failed to read value", http.StatusBadRequest)
+			return
+		}
+
+		if err := store.Set(r.Context(), key, value); err != nil {
+			me.logger.Error("failed to write key", "app", appname, "key", key, "error", err)
+			http.Error(w, "failed to write key", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := store.Delete(r.Context(), key); errors.Is(err, ErrKeyNotFound) {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			me.logger.Error("failed to delete key", "app", appname, "key", key, "error", err)
+			http.Error(w, "failed to delete key", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
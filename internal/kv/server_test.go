@@ -0,0 +1,171 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("test-key")
+
+func TestVerifyToken(t *testing.T) {
+	for _, appname := range []string{"blog", "my.blog", "a"} {
+		verified, ok := verifyToken(testKey, token(testKey, appname))
+		if !ok || verified != appname {
+			t.Errorf("expected the token of %s to be valid, got %q, %v", appname, verified, ok)
+		}
+	}
+
+	blogToken := token(testKey, "blog")
+	_, signature, _ := strings.Cut(blogToken, ".")
+	for name, value := range map[string]string{
+		"empty":               "",
+		"no signature":        "blog",
+		"empty app":           "." + signature,
+		"empty signature":     "blog.",
+		"other app":           "admin." + signature,
+		"dotted app prefix":   "blog.blog." + signature,
+		"tampered signature":  blogToken[:len(blogToken)-1] + "A",
+		"signed by other key": token([]byte("other-key"), "blog"),
+	} {
+		if appname, ok := verifyToken(testKey, value); ok {
+			t.Errorf("%s: expected %q to be rejected, got app %s", name, value, appname)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Cleanup(func() { Configure("", nil) })
+
+	if env := Env("blog"); env != nil {
+		t.Fatalf("expected no variables without a kv server, got %v", env)
+	}
+
+	Configure("http://127.0.0.1:1234", testKey)
+	env := Env("blog")
+	if !slices.Contains(env, "SMALLWEB_KV_URL=http://127.0.0.1:1234") {
+		t.Errorf("expected the url of the kv server, got %v", env)
+	}
+
+	if !slices.Contains(env, "SMALLWEB_KV_TOKEN="+token(testKey, "blog")) {
+		t.Errorf("expected the token of the app, got %v", env)
+	}
+}
+
+// newTestHandler serves the stores of the apps, each in its own dir.
+func newTestHandler(t *testing.T, apps ...string) *Handler {
+	t.Helper()
+
+	dir := t.TempDir()
+	return NewHandler(testKey, func(appname string) (string, error) {
+		if !slices.Contains(apps, appname) {
+			return "", errors.New("app not found")
+		}
+
+		return filepath.Join(dir, appname, "data", "smallweb-kv.db"), nil
+	}, nil)
+}
+
+func serve(h http.Handler, method string, target string, bearer string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHandlerAuthorization(t *testing.T) {
+	h := newTestHandler(t, "blog")
+
+	if rr := serve(h, http.MethodGet, "/key", "", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/key", nil)
+	req.Header.Set("Authorization", "Basic "+token(testKey, "blog"))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with another scheme, got %d", rr.Code)
+	}
+
+	if rr := serve(h, http.MethodGet, "/key", token([]byte("other-key"), "blog"), nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a forged token, got %d", rr.Code)
+	}
+
+	if rr := serve(h, http.MethodGet, "/key", token(testKey, "missing"), nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown app, got %d", rr.Code)
+	}
+}
+
+func TestHandlerIsolatesApps(t *testing.T) {
+	h := newTestHandler(t, "blog", "admin")
+	blogToken, adminToken := token(testKey, "blog"), token(testKey, "admin")
+
+	if rr := serve(h, http.MethodPut, "/secret", adminToken, []byte("admin value")); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body)
+	}
+
+	if rr := serve(h, http.MethodGet, "/secret", blogToken, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the key of another app to be missing, got %d: %s", rr.Code, rr.Body)
+	}
+
+	if rr := serve(h, http.MethodDelete, "/secret", blogToken, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the key of another app to be missing, got %d", rr.Code)
+	}
+
+	if rr := serve(h, http.MethodGet, "/secret", adminToken, nil); rr.Body.String() != "admin value" {
+		t.Fatalf("expected the value to be kept, got %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestHandlerKeys(t *testing.T) {
+	h := newTestHandler(t, "blog")
+	bearer := token(testKey, "blog")
+
+	for _, key := range []string{"posts/1", "posts/2", "drafts/1"} {
+		if rr := serve(h, http.MethodPut, "/"+key, bearer, []byte(key)); rr.Code != http.StatusNoContent {
+			t.Fatalf("put %s: expected 204, got %d", key, rr.Code)
+		}
+	}
+
+	rr := serve(h, http.MethodGet, "/posts/2", bearer, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "posts/2" {
+		t.Fatalf("expected the value, got %d: %s", rr.Code, rr.Body)
+	}
+
+	rr = serve(h, http.MethodGet, "/?prefix=posts/", bearer, nil)
+	var keys []string
+	if err := json.NewDecoder(rr.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(keys, []string{"posts/1", "posts/2"}) {
+		t.Fatalf("expected the keys under posts/, got %v", keys)
+	}
+
+	if rr := serve(h, http.MethodDelete, "/posts/1", bearer, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+
+	if rr := serve(h, http.MethodGet, "/posts/1", bearer, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the key to be deleted, got %d", rr.Code)
+	}
+
+	if rr := serve(h, http.MethodPut, "/large", bearer, make([]byte, maxValueSize+1)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a large value, got %d", rr.Code)
+	}
+
+	if rr := serve(h, http.MethodPost, "/", bearer, nil); rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 when writing to the root, got %d", rr.Code)
+	}
+}
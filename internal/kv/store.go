@@ -0,0 +1,97 @@
+// Package kv implements the key-value stores that smallweb hosts for apps.
+package kv
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/pomdtr/smallweb/internal/database"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// Store is the key-value store of an app, persisted in a SQLite database.
+type Store struct {
+	db *sql.DB
+}
+
+func Open(path string) (*Store, error) {
+	db, err := database.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS kv (key TEXT PRIMARY KEY, value BLOB NOT NULL) WITHOUT ROWID"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (me *Store) Close() error {
+	return me.db.Close()
+}
+
+func (me *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	if err := me.db.QueryRowContext(ctx, "SELECT value FROM kv WHERE key = ?", key).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrKeyNotFound
+		}
+
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (me *Store) Set(ctx context.Context, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	_, err := me.db.ExecContext(ctx, "INSERT INTO kv (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+// List returns the keys starting with prefix, in lexicographic order.
+func (me *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	// the prefix is matched on the byte range it covers, as LIKE would need escaping
+	rows, err := me.db.QueryContext(ctx, "SELECT key FROM kv WHERE key >= ? ORDER BY key", prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (me *Store) Delete(ctx context.Context, key string) error {
+	res, err := me.db.ExecContext(ctx, "DELETE FROM kv WHERE key = ?", key)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
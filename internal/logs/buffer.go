@@ -0,0 +1,149 @@
+package logs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a log record captured by a Buffer.
+type Entry struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Attrs   []slog.Attr
+}
+
+// Attr returns the value of the attribute with the given key, or an empty string.
+func (e Entry) Attr(key string) string {
+	for _, attr := range e.Attrs {
+		if attr.Key == key {
+			return attr.Value.String()
+		}
+	}
+
+	return ""
+}
+
+func (e Entry) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s %s", e.Time.Format(time.TimeOnly), e.Level, e.Message)
+	for _, attr := range e.Attrs {
+		fmt.Fprintf(&sb, " %s=%s", attr.Key, attr.Value)
+	}
+
+	return sb.String()
+}
+
+// Buffer keeps the most recent log entries in memory.
+type Buffer struct {
+	mu      sync.Mutex
+	entries []Entry
+	size    int
+}
+
+func NewBuffer(size int) *Buffer {
+	return &Buffer{
+		entries: make([]Entry, 0, size),
+		size:    size,
+	}
+}
+
+// Entries returns a copy of the buffered entries, oldest first.
+func (me *Buffer) Entries() []Entry {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	entries := make([]Entry, len(me.entries))
+	copy(entries, me.entries)
+	return entries
+}
+
+func (me *Buffer) add(entry Entry) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if len(me.entries) == me.size {
+		copy(me.entries, me.entries[1:])
+		me.entries = me.entries[:len(me.entries)-1]
+	}
+
+	me.entries = append(me.entries, entry)
+}
+
+// Handler returns a slog.Handler recording every record in the buffer before passing it to next.
+func (me *Buffer) Handler(next slog.Handler) slog.Handler {
+	return &handler{
+		next:   next,
+		buffer: me,
+	}
+}
+
+type handler struct {
+	next   slog.Handler
+	buffer *Buffer
+	attrs  []slog.Attr
+	group  string
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	attrs := make([]slog.Attr, 0, len(h.attrs)+record.NumAttrs())
+	attrs = append(attrs, h.attrs...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, h.qualify(attr))
+		return true
+	})
+
+	h.buffer.add(Entry{
+		Time:    record.Time,
+		Level:   record.Level,
+		Message: record.Message,
+		Attrs:   attrs,
+	})
+
+	return h.next.Handle(ctx, record)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	qualified := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	qualified = append(qualified, h.attrs...)
+	for _, attr := range attrs {
+		qualified = append(qualified, h.qualify(attr))
+	}
+
+	return &handler{
+		next:   h.next.WithAttrs(attrs),
+		buffer: h.buffer,
+		attrs:  qualified,
+		group:  h.group,
+	}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	group := name
+	if h.group != "" {
+		group = h.group + "." + name
+	}
+
+	return &handler{
+		next:   h.next.WithGroup(name),
+		buffer: h.buffer,
+		attrs:  h.attrs,
+		group:  group,
+	}
+}
+
+func (h *handler) qualify(attr slog.Attr) slog.Attr {
+	if h.group == "" {
+		return attr
+	}
+
+	return slog.Attr{Key: h.group + "." + attr.Key, Value: attr.Value}
+}
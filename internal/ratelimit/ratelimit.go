@@ -0,0 +1,140 @@
+// Package ratelimit bounds the rate of the requests served by apps, using token buckets.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second, holding up to Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// IsZero reports whether the limit is unset, meaning no limit.
+func (me Limit) IsZero() bool {
+	return me.Rate <= 0
+}
+
+func (me Limit) limiter() *rate.Limiter {
+	burst := me.Burst
+	if burst <= 0 {
+		burst = max(int(math.Ceil(me.Rate)), 1)
+	}
+
+	return rate.NewLimiter(rate.Limit(me.Rate), burst)
+}
+
+// idleClient is the duration after which the bucket of a client is dropped. It is full by then,
+// unless the rate is lower than one request per idleClient.
+const idleClient = 10 * time.Minute
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter holds the buckets of an app, and of each of its clients.
+type Limiter struct {
+	app         *rate.Limiter
+	clientLimit Limit
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+
+	allowed  atomic.Int64
+	rejected atomic.Int64
+}
+
+// New returns a limiter applying appLimit to all the requests, and clientLimit to the requests of each client.
+func New(appLimit Limit, clientLimit Limit) *Limiter {
+	me := &Limiter{
+		clientLimit: clientLimit,
+		clients:     make(map[string]*client),
+		lastSweep:   time.Now(),
+	}
+
+	if !appLimit.IsZero() {
+		me.app = appLimit.limiter()
+	}
+
+	return me
+}
+
+// Allow takes a token for a request of the client. When the request is rejected, it returns how
+// long the client should wait before retrying.
+func (me *Limiter) Allow(clientIP string) (bool, time.Duration) {
+	now := time.Now()
+
+	var limiters []*rate.Limiter
+	if c := me.client(clientIP, now); c != nil {
+		limiters = append(limiters, c)
+	}
+	if me.app != nil {
+		limiters = append(limiters, me.app)
+	}
+
+	var reservations []*rate.Reservation
+	for _, limiter := range limiters {
+		reservation := limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+			// tokens taken from the other buckets are given back
+			reservation.CancelAt(now)
+			for _, r := range reservations {
+				r.CancelAt(now)
+			}
+
+			me.rejected.Add(1)
+			return false, max(delay, time.Second)
+		}
+
+		reservations = append(reservations, reservation)
+	}
+
+	me.allowed.Add(1)
+	return true, 0
+}
+
+func (me *Limiter) client(clientIP string, now time.Time) *rate.Limiter {
+	if me.clientLimit.IsZero() {
+		return nil
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	// clients are forgotten once idle, so that the map does not grow with each new address
+	if now.Sub(me.lastSweep) > time.Minute {
+		for ip, c := range me.clients {
+			if now.Sub(c.lastSeen) > idleClient {
+				delete(me.clients, ip)
+			}
+		}
+		me.lastSweep = now
+	}
+
+	c, ok := me.clients[clientIP]
+	if !ok {
+		c = &client{limiter: me.clientLimit.limiter()}
+		me.clients[clientIP] = c
+	}
+	c.lastSeen = now
+
+	return c.limiter
+}
+
+// Counters returns the number of requests allowed and rejected since the last call, and the
+// number of clients currently tracked.
+func (me *Limiter) Counters() (allowed int64, rejected int64, clients int) {
+	me.mu.Lock()
+	clients = len(me.clients)
+	me.mu.Unlock()
+
+	return me.allowed.Swap(0), me.rejected.Swap(0), clients
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// slow limits are not refilled during a test.
+const slow = 0.001
+
+func TestNoLimits(t *testing.T) {
+	l := New(Limit{}, Limit{})
+	for range 100 {
+		if ok, _ := l.Allow("10.0.0.1"); !ok {
+			t.Fatal("expected requests to be allowed without limits")
+		}
+	}
+
+	if allowed, rejected, clients := l.Counters(); allowed != 100 || rejected != 0 || clients != 0 {
+		t.Fatalf("expected 100 allowed requests and no tracked clients, got %d, %d, %d", allowed, rejected, clients)
+	}
+}
+
+func TestClientBurst(t *testing.T) {
+	l := New(Limit{}, Limit{Rate: slow, Burst: 2})
+
+	for i := range 2 {
+		if ok, _ := l.Allow("10.0.0.1"); !ok {
+			t.Fatalf("expected request %d to be allowed within the burst", i+1)
+		}
+	}
+
+	if ok, _ := l.Allow("10.0.0.1"); ok {
+		t.Fatal("expected the request above the burst to be rejected")
+	}
+
+	// each client has its own bucket
+	if ok, _ := l.Allow("10.0.0.2"); !ok {
+		t.Fatal("expected another client to be allowed")
+	}
+
+	if allowed, rejected, clients := l.Counters(); allowed != 3 || rejected != 1 || clients != 2 {
+		t.Fatalf("expected 3 allowed, 1 rejected and 2 clients, got %d, %d, %d", allowed, rejected, clients)
+	}
+
+	// counters are reset on each call
+	if allowed, rejected, _ := l.Counters(); allowed != 0 || rejected != 0 {
+		t.Fatalf("expected the counters to be reset, got %d, %d", allowed, rejected)
+	}
+}
+
+func TestDefaultBurst(t *testing.T) {
+	for rate, burst := range map[float64]int{slow: 1, 1: 1, 2.5: 3, 10: 10} {
+		if limiter := (Limit{Rate: rate}).limiter(); limiter.Burst() != burst {
+			t.Errorf("rate %v: expected a burst of %d, got %d", rate, burst, limiter.Burst())
+		}
+	}
+}
+
+func TestRejectedRequestsAreRefunded(t *testing.T) {
+	l := New(Limit{Rate: slow, Burst: 1}, Limit{Rate: slow, Burst: 1})
+
+	if ok, _ := l.Allow("10.0.0.1"); !ok {
+		t.Fatal("expected the first request to be allowed")
+	}
+
+	// the app bucket is empty, the token taken from the bucket of the client is given back
+	if ok, _ := l.Allow("10.0.0.2"); ok {
+		t.Fatal("expected the request to be rejected by the app limit")
+	}
+
+	l.mu.Lock()
+	tokens := l.clients["10.0.0.2"].limiter.Tokens()
+	l.mu.Unlock()
+
+	if math.Abs(tokens-1) > 0.01 {
+		t.Fatalf("expected the token of the client to be refunded, got %v tokens", tokens)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	// a token is added every 10 seconds
+	l := New(Limit{Rate: 0.1, Burst: 1}, Limit{})
+	l.Allow("10.0.0.1")
+
+	ok, retryAfter := l.Allow("10.0.0.1")
+	if ok {
+		t.Fatal("expected the request to be rejected")
+	}
+
+	if retryAfter < 9*time.Second || retryAfter > 10*time.Second {
+		t.Fatalf("expected to retry once a token is added, got %s", retryAfter)
+	}
+
+	// clients are asked to wait at least a second, as Retry-After is in seconds
+	l = New(Limit{Rate: 100, Burst: 1}, Limit{})
+	l.Allow("10.0.0.1")
+	if ok, retryAfter := l.Allow("10.0.0.1"); ok || retryAfter != time.Second {
+		t.Fatalf("expected to retry after a second, got %v, %s", ok, retryAfter)
+	}
+}
+
+func TestIdleClientsAreForgotten(t *testing.T) {
+	l := New(Limit{}, Limit{Rate: slow, Burst: 1})
+	l.Allow("10.0.0.1")
+	l.Allow("10.0.0.2")
+
+	l.mu.Lock()
+	l.clients["10.0.0.1"].lastSeen = time.Now().Add(-2 * idleClient)
+	l.lastSweep = time.Now().Add(-2 * time.Minute)
+	l.mu.Unlock()
+
+	// the next request sweeps the idle clients
+	l.Allow("10.0.0.3")
+	if _, _, clients := l.Counters(); clients != 2 {
+		t.Fatalf("expected the idle client to be forgotten, got %d clients", clients)
+	}
+
+	// a forgotten client starts with a full bucket
+	if ok, _ := l.Allow("10.0.0.1"); !ok {
+		t.Fatal("expected the forgotten client to be allowed")
+	}
+}
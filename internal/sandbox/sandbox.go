@@ -0,0 +1,27 @@
+// Package sandbox isolates the deno processes of apps at the os level, on top of deno permissions.
+package sandbox
+
+// ExecCommand is the hidden smallweb command setting up the sandbox before running deno.
+const ExecCommand = "sandbox-exec"
+
+// UIDBase is the first uid allocated to sandboxed apps.
+const UIDBase = 200000
+
+// Options describes the sandbox of an app.
+type Options struct {
+	RootDir string
+	App     string
+	// ReadOnly and ReadWrite are the paths exposed to the process, in addition to system libraries.
+	ReadOnly  []string
+	ReadWrite []string
+}
+
+// Config is passed to the sandbox-exec command.
+type Config struct {
+	UID       int      `json:"uid"`
+	GID       int      `json:"gid"`
+	Root      string   `json:"root"`
+	Dir       string   `json:"dir"`
+	ReadOnly  []string `json:"readOnly"`
+	ReadWrite []string `json:"readWrite"`
+}
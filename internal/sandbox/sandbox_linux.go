@@ -0,0 +1,471 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/adrg/xdg"
+	"golang.org/x/sys/unix"
+)
+
+// systemPaths are exposed read-only to sandboxed processes, when they exist.
+var systemPaths = []string{
+	"/usr",
+	"/lib",
+	"/lib32",
+	"/lib64",
+	"/bin",
+	"/sbin",
+	"/etc/ca-certificates",
+	"/etc/group",
+	"/etc/hosts",
+	"/etc/localtime",
+	"/etc/nsswitch.conf",
+	"/etc/passwd",
+	"/etc/pki",
+	"/etc/resolv.conf",
+	"/etc/ssl",
+}
+
+// devices are exposed read-write to sandboxed processes.
+var devices = []string{
+	"/dev/null",
+	"/dev/zero",
+	"/dev/full",
+	"/dev/random",
+	"/dev/urandom",
+	"/dev/tty",
+}
+
+// Wrap rewrites the command to run it in the sandbox of an app: the process runs as a
+// dedicated user, in a mount namespace exposing only system libraries and the given paths,
+// with landlock and seccomp restrictions applied when the kernel supports them.
+func Wrap(command *exec.Cmd, opts Options) error {
+	if os.Geteuid() != 0 {
+		return errors.New("sandboxing requires running smallweb as root")
+	}
+
+	uid, err := allocateUID(opts.RootDir, opts.App)
+	if err != nil {
+		return fmt.Errorf("could not allocate a uid: %w", err)
+	}
+
+	// each app gets its own deno cache, as a shared one could be poisoned by other apps
+	stateDir := filepath.Join(xdg.CacheHome, "smallweb", "sandbox", opts.App)
+	denoDir := filepath.Join(stateDir, "deno")
+	root := filepath.Join(stateDir, "root")
+	for _, dir := range []string{denoDir, root} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	readWrite := append([]string{denoDir}, opts.ReadWrite...)
+	for _, path := range readWrite {
+		if err := chownAll(path, uid, uid); err != nil {
+			return fmt.Errorf("could not give ownership of %s to the app: %w", path, err)
+		}
+	}
+
+	deno, err := filepath.EvalSymlinks(command.Path)
+	if err != nil {
+		return err
+	}
+
+	dir := command.Dir
+	if dir == "" {
+		dir = "/tmp"
+	}
+
+	conf, err := json.Marshal(Config{
+		UID:       uid,
+		GID:       uid,
+		Root:      root,
+		Dir:       dir,
+		ReadOnly:  append([]string{deno}, opts.ReadOnly...),
+		ReadWrite: readWrite,
+	})
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	command.Path = executable
+	command.Args = append([]string{executable, ExecCommand, string(conf), "--", deno}, command.Args[1:]...)
+	if command.Env == nil {
+		command.Env = os.Environ()
+	}
+	command.Env = append(command.Env, "HOME=/tmp", "DENO_DIR="+denoDir)
+
+	if command.SysProcAttr == nil {
+		command.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	command.SysProcAttr.Cloneflags |= unix.CLONE_NEWNS | unix.CLONE_NEWIPC | unix.CLONE_NEWUTS
+
+	return nil
+}
+
+// allocateUID returns the uid of an app, allocating a new one if needed.
+func allocateUID(rootDir, appname string) (int, error) {
+	registryPath := filepath.Join(rootDir, ".smallweb", "uids.json")
+	if err := os.MkdirAll(filepath.Dir(registryPath), 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(registryPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// apps may be started concurrently, by several smallweb processes
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer unix.Flock(int(f.Fd()), unix.LOCK_UN)
+
+	uids := make(map[string]int)
+	if info, err := f.Stat(); err != nil {
+		return 0, err
+	} else if info.Size() > 0 {
+		if err := json.NewDecoder(f).Decode(&uids); err != nil {
+			return 0, fmt.Errorf("could not decode %s: %w", registryPath, err)
+		}
+	}
+
+	if uid, ok := uids[appname]; ok {
+		return uid, nil
+	}
+
+	uid := UIDBase
+	for _, allocated := range uids {
+		uid = max(uid, allocated+1)
+	}
+	uids[appname] = uid
+
+	data, err := json.MarshalIndent(uids, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+
+	if _, err := f.WriteAt(append(data, '\n'), 0); err != nil {
+		return 0, err
+	}
+
+	return uid, nil
+}
+
+// chownAll gives ownership of the files under root to the given user, creating root if needed.
+func chownAll(root string, uid, gid int) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) == uid && int(stat.Gid) == gid {
+			return nil
+		}
+
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+type mount struct {
+	path     string
+	writable bool
+}
+
+// Exec sets up the sandbox described by conf, and replaces the current process with argv.
+// It must run as root in a new mount namespace.
+func Exec(conf Config, argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("no command given")
+	}
+
+	// credentials, landlock and seccomp apply to the thread calling exec
+	runtime.LockOSThread()
+
+	if err := setupRoot(conf); err != nil {
+		return fmt.Errorf("could not set up the filesystem: %w", err)
+	}
+
+	if err := os.Chdir(conf.Dir); err != nil {
+		return err
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("could not set no_new_privs: %w", err)
+	}
+
+	if err := restrictPaths(conf); err != nil {
+		return fmt.Errorf("could not apply landlock rules: %w", err)
+	}
+
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+
+	if err := syscall.Setgid(conf.GID); err != nil {
+		return err
+	}
+
+	if err := syscall.Setuid(conf.UID); err != nil {
+		return err
+	}
+
+	if err := filterSyscalls(); err != nil {
+		return fmt.Errorf("could not apply seccomp filter: %w", err)
+	}
+
+	return syscall.Exec(argv[0], argv, os.Environ())
+}
+
+// setupRoot builds a new root filesystem from the exposed paths, and pivots to it.
+func setupRoot(conf Config) error {
+	// mounts must not propagate to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+
+	root := conf.Root
+	if err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+		return err
+	}
+
+	var mounts []mount
+	for _, path := range systemPaths {
+		mounts = append(mounts, mount{path: path})
+	}
+	for _, path := range devices {
+		mounts = append(mounts, mount{path: path, writable: true})
+	}
+	for _, path := range conf.ReadOnly {
+		mounts = append(mounts, mount{path: path})
+	}
+	for _, path := range conf.ReadWrite {
+		mounts = append(mounts, mount{path: path, writable: true})
+	}
+
+	// parents are mounted before their children, e.g. an app dir before its data dir
+	slices.SortStableFunc(mounts, func(a, b mount) int {
+		return strings.Count(a.path, "/") - strings.Count(b.path, "/")
+	})
+
+	for _, dir := range []string{"tmp", "dev", "proc"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return err
+	}
+
+	if err := unix.Mount("tmpfs", filepath.Join(root, "dev"), "tmpfs", unix.MS_NOSUID|unix.MS_NOEXEC, "mode=0755"); err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		if err := bindMount(root, m); err != nil {
+			return fmt.Errorf("could not mount %s: %w", m.path, err)
+		}
+	}
+
+	if err := unix.Mount("proc", filepath.Join(root, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+
+	oldRoot := filepath.Join(root, ".old")
+	if err := os.Mkdir(oldRoot, 0700); err != nil {
+		return err
+	}
+
+	if err := unix.PivotRoot(root, oldRoot); err != nil {
+		return err
+	}
+
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	if err := unix.Unmount("/.old", unix.MNT_DETACH); err != nil {
+		return err
+	}
+
+	if err := os.Remove("/.old"); err != nil {
+		return err
+	}
+
+	return unix.Mount("", "/", "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, "")
+}
+
+// bindMount exposes a path of the host at the same location in the new root.
+func bindMount(root string, m mount) error {
+	info, err := os.Lstat(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	target := filepath.Join(root, m.path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// merged /usr layouts link /bin and /lib to /usr
+	if info.Mode()&os.ModeSymlink != 0 && !strings.HasPrefix(m.path, "/etc/") {
+		link, err := os.Readlink(m.path)
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(link, target)
+	}
+
+	info, err = os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else if f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return err
+	} else {
+		f.Close()
+	}
+
+	if err := unix.Mount(m.path, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+
+	// devices live on a noexec tmpfs, and are always writable
+	if strings.HasPrefix(m.path, "/dev/") {
+		return nil
+	}
+
+	flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_NOSUID)
+	if !m.writable {
+		flags |= unix.MS_RDONLY
+	}
+
+	return unix.Mount("", target, "", flags, "")
+}
+
+// restrictPaths applies a landlock ruleset matching the mounts, if the kernel supports it.
+func restrictPaths(conf Config) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		// landlock is not available
+		return nil
+	}
+
+	readAccess := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR)
+	writeAccess := uint64(unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		writeAccess |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		writeAccess |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: readAccess | writeAccess}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer unix.Close(int(fd))
+
+	rules := map[string]uint64{
+		"/tmp":  readAccess | writeAccess,
+		"/dev":  readAccess | unix.LANDLOCK_ACCESS_FS_WRITE_FILE,
+		"/proc": readAccess,
+	}
+	for _, path := range systemPaths {
+		rules[path] = readAccess
+	}
+	for _, path := range conf.ReadOnly {
+		rules[path] = readAccess
+	}
+	for _, path := range conf.ReadWrite {
+		rules[path] = readAccess | writeAccess
+	}
+
+	for path, access := range rules {
+		if err := addLandlockRule(int(fd), path, access); err != nil {
+			return fmt.Errorf("could not add rule for %s: %w", path, err)
+		}
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func addLandlockRule(rulesetFd int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return err
+	}
+
+	// directory rights can only be granted on directories
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errUnsupported = errors.New("sandboxing is only supported on linux")
+
+func Wrap(command *exec.Cmd, opts Options) error {
+	return errUnsupported
+}
+
+func Exec(conf Config, argv []string) error {
+	return errUnsupported
+}
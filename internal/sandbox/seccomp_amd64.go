@@ -0,0 +1,15 @@
+//go:build linux && amd64
+
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+// syscalls of the x32 abi have this bit set, and bypass the numbers checked by the filter.
+const syscallBitMask = 0x40000000
+
+var archDeniedSyscalls = []uintptr{
+	unix.SYS_IOPERM,
+	unix.SYS_IOPL,
+}
@@ -0,0 +1,10 @@
+//go:build linux && !amd64 && !arm64
+
+package sandbox
+
+// seccomp filters are only installed on amd64 and arm64.
+const auditArch = 0
+
+const syscallBitMask = 0
+
+var archDeniedSyscalls []uintptr
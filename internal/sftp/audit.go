@@ -0,0 +1,87 @@
+package sftp
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sessionLogger returns a logger tagging every record with the user and key of the session.
+func sessionLogger(logger *slog.Logger, session ssh.Session) *slog.Logger {
+	if logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+
+	fingerprint := ""
+	if key := session.PublicKey(); key != nil {
+		fingerprint = gossh.FingerprintSHA256(key)
+	}
+
+	return logger.With(
+		"user", session.User(),
+		"fingerprint", fingerprint,
+		"remote addr", session.RemoteAddr().String(),
+	)
+}
+
+// auditCmd logs a successful file command.
+func (h *handler) auditCmd(r *sftp.Request) {
+	filepath := path.Clean("/" + r.Filepath)
+
+	switch r.Method {
+	case "Rename", "Link":
+		h.logger.Info("sftp "+strings.ToLower(r.Method), "path", filepath, "target", path.Clean("/"+r.Target))
+	case "PosixRename":
+		h.logger.Info("sftp posix-rename", "path", filepath, "target", path.Clean("/"+r.Target))
+	case "Symlink":
+		// r.Filepath holds the raw link target, and r.Target the link path
+		h.logger.Info("sftp symlink", "path", path.Clean("/"+r.Target), "target", r.Filepath)
+	case "Remove", "Rmdir", "Mkdir":
+		h.logger.Info("sftp "+strings.ToLower(r.Method), "path", filepath)
+	case "Setstat":
+		attrs := r.Attributes()
+		flags := r.AttrFlags()
+
+		args := []any{"path", filepath}
+		if flags.Size {
+			args = append(args, "size", attrs.Size)
+		}
+		if flags.Permissions {
+			args = append(args, "mode", attrs.FileMode().Perm().String())
+		}
+		if flags.UidGid {
+			args = append(args, "uid", attrs.UID, "gid", attrs.GID)
+		}
+		if flags.Acmodtime {
+			args = append(args, "mtime", attrs.ModTime())
+		}
+
+		h.logger.Info("sftp setstat", args...)
+	}
+}
+
+// auditWriter counts the bytes written to a file, and logs them once the file is closed.
+type auditWriter struct {
+	*os.File
+	handler *handler
+	path    string
+	written atomic.Int64
+}
+
+func (w *auditWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.File.WriteAt(p, off)
+	w.written.Add(int64(n))
+	return n, err
+}
+
+func (w *auditWriter) Close() error {
+	err := w.File.Close()
+	w.handler.logger.Info("sftp write", "path", path.Clean("/"+w.path), "bytes", w.written.Load())
+	return err
+}
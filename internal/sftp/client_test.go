@@ -0,0 +1,217 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestClient connects a sftp client to a request server using the handler, over an in-memory pipe.
+func newTestClient(t *testing.T, h *handler) *sftp.Client {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve()
+	}()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		if err := <-done; err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("server: %v", err)
+		}
+	})
+
+	return client
+}
+
+func TestClientLstat(t *testing.T) {
+	h, _ := newTestHandler(t)
+	client := newTestClient(t, h)
+
+	if err := client.Symlink("file.txt", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := client.Lstat("/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected a symlink, got mode %s", info.Mode())
+	}
+
+	info, err = client.Stat("/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.Mode().IsRegular() || info.Size() != int64(len("file")) {
+		t.Fatalf("expected stat to follow the link, got mode %s and size %d", info.Mode(), info.Size())
+	}
+}
+
+func TestClientReadlink(t *testing.T) {
+	h, base := newTestHandler(t)
+	client := newTestClient(t, h)
+
+	// absolute links inside the root are shown as sftp paths
+	if err := os.Symlink(filepath.Join(base, "root", "file.txt"), filepath.Join(base, "root", "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := client.ReadLink("/inside")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "/file.txt" {
+		t.Fatalf("expected /file.txt, got %s", target)
+	}
+
+	if err := client.Symlink("file.txt", "/relative"); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err := client.ReadLink("/relative"); err != nil || target != "file.txt" {
+		t.Fatalf("expected file.txt, got %s, %v", target, err)
+	}
+
+	// the host path of links pointing outside of the root is never shown
+	for _, link := range []string{"/absolute", "/parent"} {
+		target, err := client.ReadLink(link)
+		if err == nil {
+			t.Fatalf("expected readlink %s to fail, got %s", link, target)
+		}
+	}
+}
+
+func TestClientRealPath(t *testing.T) {
+	h, _ := newTestHandler(t)
+	client := newTestClient(t, h)
+
+	if err := client.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Symlink("dir", "/dirlink"); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, expected := range map[string]string{
+		"/dirlink/new.txt": "/dir/new.txt",
+		"/dir/../file.txt": "/file.txt",
+		"/../../file.txt":  "/file.txt",
+		"missing/child":    "/missing/child",
+	} {
+		resolved, err := client.RealPath(p)
+		if err != nil {
+			t.Fatalf("realpath %s: %v", p, err)
+		}
+
+		if resolved != expected {
+			t.Errorf("realpath %s: expected %s, got %s", p, expected, resolved)
+		}
+	}
+
+	if resolved, err := client.RealPath("/parent/secret.txt"); err == nil {
+		t.Fatalf("expected realpath to refuse links outside of the root, got %s", resolved)
+	}
+}
+
+func TestClientPosixRename(t *testing.T) {
+	h, base := newTestHandler(t)
+	client := newTestClient(t, h)
+
+	f, err := client.Create("/other.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// plain renames never overwrite
+	if err := client.Rename("/other.txt", "/file.txt"); err == nil {
+		t.Fatal("expected rename to fail on an existing file")
+	}
+
+	if err := client.PosixRename("/other.txt", "/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(base, "root", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "other" {
+		t.Fatalf("expected the file to be replaced, got %q", content)
+	}
+
+	if err := client.PosixRename("/file.txt", "/../secret.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err := os.ReadFile(filepath.Join(base, "secret.txt")); err != nil || string(content) != "secret" {
+		t.Fatalf("posix-rename replaced a file outside of the root: %q, %v", content, err)
+	}
+}
+
+func TestClientStatVFS(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("statvfs is only supported on linux and darwin")
+	}
+
+	h, _ := newTestHandler(t)
+	client := newTestClient(t, h)
+
+	stat, err := client.StatVFS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Bsize == 0 || stat.Blocks == 0 {
+		t.Fatalf("expected filesystem stats, got %+v", stat)
+	}
+}
+
+func TestClientReadOnly(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.readOnly = true
+	client := newTestClient(t, h)
+
+	if _, err := client.Create("/new.txt"); err == nil {
+		t.Fatal("created a file in a read-only session")
+	}
+
+	if err := client.PosixRename("/file.txt", "/moved.txt"); err == nil {
+		t.Fatal("renamed a file in a read-only session")
+	}
+
+	if _, err := client.Lstat("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,12 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
-	"time"
-
 	"github.com/charmbracelet/ssh"
 	"github.com/charmbracelet/wish"
 	"github.com/pkg/sftp"
@@ -18,84 +18,96 @@ import (
 // Based on https://github.com/pkg/sftp/blob/master/request-example.go
 
 type handler struct {
-	session ssh.Session
-	root    *os.Root
+	session       ssh.Session
+	root          *os.Root
+	readOnly      bool
+	readOnlyPaths []string
+	logger        *slog.Logger
 }
 
 func (h *handler) Filecmd(r *sftp.Request) error {
+	// r.Target is the destination of renames and links, and the link path of symlinks,
+	// whose r.Filepath is the link target
+	paths := []string{r.Filepath}
 	switch r.Method {
-	case "Rename":
-		if _, err := h.root.Stat(strings.TrimPrefix(r.Filepath, "/")); err != nil {
-			return err
-		}
+	case "Rename", "Link":
+		paths = append(paths, r.Target)
+	case "Symlink":
+		paths = []string{r.Target}
+	}
 
-		src := filepath.Join(h.root.Name(), strings.TrimPrefix(r.Filepath, "/"))
-		dst := filepath.Join(h.root.Name(), strings.TrimPrefix(r.Target, "/"))
-		return os.Rename(src, dst)
-	case "Link":
-		if _, err := h.root.Stat(strings.TrimPrefix(r.Filepath, "/")); err != nil {
+	for _, p := range paths {
+		if err := h.checkWritable(p); err != nil {
 			return err
 		}
+	}
+
+	if err := h.filecmd(r); err != nil {
+		return err
+	}
+
+	h.auditCmd(r)
+	return nil
+}
 
-		if _, err := h.root.Stat(strings.TrimPrefix(r.Target, "/")); err == nil {
-			return fmt.Errorf("target file exists")
+func (h *handler) filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Rename":
+		// unlike posix-rename, sftp renames must not overwrite existing files
+		if _, err := h.root.Lstat(rootPath(r.Target)); err == nil {
+			return os.ErrExist
 		} else if !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
 
-		src := filepath.Join(h.root.Name(), strings.TrimPrefix(r.Filepath, "/"))
-		dst := filepath.Join(h.root.Name(), strings.TrimPrefix(r.Target, "/"))
-		return os.Link(src, dst)
+		return h.root.Rename(rootPath(r.Filepath), rootPath(r.Target))
+	case "Link":
+		return h.root.Link(rootPath(r.Filepath), rootPath(r.Target))
 	case "Symlink":
-		if _, err := h.root.Stat(strings.TrimPrefix(r.Filepath, "/")); err != nil {
-			return fmt.Errorf("file does not exist")
-		}
-
-		if _, err := h.root.Stat(strings.TrimPrefix(r.Target, "/")); err == nil {
-			return fmt.Errorf("target file exists")
-		} else if !errors.Is(err, os.ErrNotExist) {
+		// r.Filepath holds the raw link target, and r.Target the link path
+		target, err := symlinkTarget(r.Filepath, r.Target)
+		if err != nil {
 			return err
 		}
 
-		src := filepath.Join(h.root.Name(), strings.TrimPrefix(r.Filepath, "/"))
-		dst := filepath.Join(h.root.Name(), strings.TrimPrefix(r.Target, "/"))
-		return os.Symlink(src, dst)
+		return h.root.Symlink(target, rootPath(r.Target))
 	case "Rmdir":
-		return h.root.Remove(strings.TrimPrefix(r.Filepath, "/"))
+		return h.root.Remove(rootPath(r.Filepath))
 	case "Remove":
-		return h.root.Remove(strings.TrimPrefix(r.Filepath, "/"))
+		return h.root.Remove(rootPath(r.Filepath))
 	case "Mkdir":
-		return h.root.Mkdir(strings.TrimPrefix(r.Filepath, "/"), 0777)
+		return h.root.Mkdir(rootPath(r.Filepath), 0777)
 	case "Setstat":
-		if _, err := h.root.Stat(strings.TrimPrefix(r.Filepath, "/")); err != nil {
-			return fmt.Errorf("file does not exist")
-		}
-
-		fp := filepath.Join(h.root.Name(), strings.TrimPrefix(r.Filepath, "/"))
+		name := rootPath(r.Filepath)
 		attrs := r.Attributes()
+		flags := r.AttrFlags()
 
-		if attrs.Size != 0 {
-			if err := os.Truncate(fp, int64(attrs.Size)); err != nil {
+		if flags.Size {
+			f, err := h.root.OpenFile(name, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if err := f.Truncate(int64(attrs.Size)); err != nil {
 				return err
 			}
 		}
 
-		if attrs.Mode != 0 {
-			if err := os.Chmod(fp, os.FileMode(attrs.Mode)); err != nil {
+		if flags.Permissions {
+			if err := h.root.Chmod(name, attrs.FileMode().Perm()); err != nil {
 				return err
 			}
 		}
 
-		if attrs.GID != 0 || attrs.UID != 0 {
-			if err := os.Chown(fp, int(attrs.UID), int(attrs.GID)); err != nil {
+		if flags.UidGid {
+			if err := h.root.Chown(name, int(attrs.UID), int(attrs.GID)); err != nil {
 				return err
 			}
 		}
 
-		if attrs.Atime != 0 && attrs.Mtime != 0 {
-			atime := time.Unix(int64(attrs.Atime), 0)
-			mtime := time.Unix(int64(attrs.Mtime), 0)
-			if err := os.Chtimes(fp, atime, mtime); err != nil {
+		if flags.Acmodtime {
+			if err := h.root.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
 				return err
 			}
 		}
@@ -108,28 +120,11 @@ func (h *handler) Filecmd(r *sftp.Request) error {
 func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	switch r.Method {
 	case "List":
-		if r.Filepath == "/" {
-			entries, err := os.ReadDir(h.root.Name())
-			if err != nil {
-				return nil, err
-			}
-
-			var fileInfos []os.FileInfo
-			for _, entry := range entries {
-				fileInfo, err := entry.Info()
-				if err != nil {
-					return nil, err
-				}
-				fileInfos = append(fileInfos, fileInfo)
-			}
-
-			return listerat(fileInfos), nil
-		}
-
-		f, err := h.root.Open(strings.TrimPrefix(r.Filepath, "/"))
+		f, err := h.root.Open(rootPath(r.Filepath))
 		if err != nil {
 			return nil, err
 		}
+		defer f.Close()
 
 		entries, err := f.ReadDir(0)
 		if err != nil {
@@ -148,16 +143,7 @@ func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		return listerat(fileInfos), nil
 
 	case "Stat":
-		if r.Filepath == "/" {
-			stat, err := os.Stat(h.root.Name())
-			if err != nil {
-				return nil, err
-			}
-
-			return listerat([]os.FileInfo{stat}), nil
-		}
-
-		info, err := h.root.Stat(strings.TrimPrefix(r.Filepath, "/"))
+		info, err := h.root.Stat(rootPath(r.Filepath))
 		if err != nil {
 			return nil, err
 		}
@@ -168,13 +154,193 @@ func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	return nil, errors.New("unsupported")
 }
 
+func (h *handler) PosixRename(r *sftp.Request) error {
+	for _, p := range []string{r.Filepath, r.Target} {
+		if err := h.checkWritable(p); err != nil {
+			return err
+		}
+	}
+
+	if err := h.root.Rename(rootPath(r.Filepath), rootPath(r.Target)); err != nil {
+		return err
+	}
+
+	h.auditCmd(r)
+	return nil
+}
+
+func (h *handler) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	f, err := h.root.Open(rootPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return statVFS(f)
+}
+
+func (h *handler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := h.root.Lstat(rootPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+
+	return listerat([]os.FileInfo{info}), nil
+}
+
+func (h *handler) Readlink(p string) (string, error) {
+	target, err := h.root.Readlink(rootPath(p))
+	if err != nil {
+		return "", err
+	}
+
+	// show absolute links pointing inside the root as sftp paths, and hide the layout of the
+	// server for the others, as symlinkTarget does when creating links
+	if filepath.IsAbs(target) {
+		rel, err := filepath.Rel(h.root.Name(), target)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("symlink %s points outside of the root: %w", path.Clean("/"+p), os.ErrPermission)
+		}
+
+		return path.Join("/", filepath.ToSlash(rel)), nil
+	}
+
+	target = filepath.ToSlash(target)
+	if climbsAboveRoot(path.Dir(path.Clean("/"+p)), target) {
+		return "", fmt.Errorf("symlink %s points outside of the root: %w", path.Clean("/"+p), os.ErrPermission)
+	}
+
+	return target, nil
+}
+
+// RealPath resolves symlinks in p, without leaving the session root.
+// Missing path components are kept as is, as clients use realpath before creating files.
+func (h *handler) RealPath(p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+p), "/"), "/")
+
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" {
+			continue
+		}
+
+		current := path.Join(resolved, part)
+		info, err := h.root.Lstat(rootPath(current))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = current
+			continue
+		}
+
+		hops++
+		if hops > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+
+		target, err := h.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+
+		resolved = "/"
+		parts = append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), parts...)
+	}
+
+	return resolved, nil
+}
+
 func (h *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
-	f, err := h.root.OpenFile(strings.TrimPrefix(r.Filepath, "/"), flag(r.Pflags()), 0644)
+	if err := h.checkWritable(r.Filepath); err != nil {
+		return nil, err
+	}
+
+	f, err := h.root.OpenFile(rootPath(r.Filepath), flag(r.Pflags()), 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	return f, nil
+	return &auditWriter{File: f, handler: h, path: r.Filepath}, nil
+}
+
+// checkWritable returns an error if the session cannot modify p. Symlinks are resolved, so
+// that read-only files cannot be modified through a link.
+func (h *handler) checkWritable(p string) error {
+	if h.readOnly {
+		return os.ErrPermission
+	}
+
+	names := []string{rootPath(p)}
+	if resolved, err := h.RealPath(p); err == nil {
+		names = append(names, rootPath(resolved))
+	}
+
+	for _, name := range names {
+		for _, readOnlyPath := range h.readOnlyPaths {
+			// names are compared regardless of case, for case-insensitive filesystems
+			if strings.EqualFold(name, readOnlyPath) || len(name) > len(readOnlyPath) && name[len(readOnlyPath)] == '/' && strings.EqualFold(name[:len(readOnlyPath)], readOnlyPath) {
+				return fmt.Errorf("%s is read-only: %w", path.Clean("/"+p), os.ErrPermission)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rootPath converts an absolute sftp path to a path relative to the session root.
+func rootPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+
+	return p
+}
+
+// symlinkTarget rewrites the target of a new symlink as a path relative to the link,
+// so that it cannot point outside of the session root. Absolute targets are resolved
+// from the session root.
+func symlinkTarget(target string, linkpath string) (string, error) {
+	linkdir := path.Dir(path.Clean("/" + linkpath))
+
+	resolved := target
+	if !path.IsAbs(target) {
+		if climbsAboveRoot(linkdir, target) {
+			return "", fmt.Errorf("symlink target %s is outside of the root", target)
+		}
+
+		resolved = path.Join(linkdir, target)
+	}
+
+	return filepath.Rel(filepath.FromSlash(linkdir), filepath.FromSlash(path.Clean(resolved)))
+}
+
+// climbsAboveRoot reports whether a relative target, resolved from dir, goes above the root.
+func climbsAboveRoot(dir string, target string) bool {
+	depth := 0
+	if dir := strings.Trim(dir, "/"); dir != "" {
+		depth = strings.Count(dir, "/") + 1
+	}
+
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+
+	return false
 }
 
 func flag(pflags sftp.FileOpenFlags) int {
@@ -202,11 +368,11 @@ func flag(pflags sftp.FileOpenFlags) int {
 }
 
 func (h *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
-	if r.Filepath == "/" {
+	if rootPath(r.Filepath) == "." {
 		return nil, os.ErrInvalid
 	}
 
-	return h.root.Open(strings.TrimPrefix(r.Filepath, "/"))
+	return h.root.Open(rootPath(r.Filepath))
 }
 
 type handlererr struct {
@@ -220,6 +386,20 @@ func (f *handlererr) Filecmd(r *sftp.Request) error {
 	}
 	return err
 }
+func (f *handlererr) PosixRename(r *sftp.Request) error {
+	err := f.Handler.PosixRename(r)
+	if err != nil {
+		wish.Errorln(f.Handler.session, err)
+	}
+	return err
+}
+func (f *handlererr) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	result, err := f.Handler.StatVFS(r)
+	if err != nil {
+		wish.Errorln(f.Handler.session, err)
+	}
+	return result, err
+}
 func (f *handlererr) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	result, err := f.Handler.Filelist(r)
 	if err != nil {
@@ -227,6 +407,27 @@ func (f *handlererr) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	}
 	return result, err
 }
+func (f *handlererr) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	result, err := f.Handler.Lstat(r)
+	if err != nil {
+		wish.Errorln(f.Handler.session, err)
+	}
+	return result, err
+}
+func (f *handlererr) Readlink(p string) (string, error) {
+	result, err := f.Handler.Readlink(p)
+	if err != nil {
+		wish.Errorln(f.Handler.session, err)
+	}
+	return result, err
+}
+func (f *handlererr) RealPath(p string) (string, error) {
+	result, err := f.Handler.RealPath(p)
+	if err != nil {
+		wish.Errorln(f.Handler.session, err)
+	}
+	return result, err
+}
 func (f *handlererr) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 	result, err := f.Handler.Filewrite(r)
 	if err != nil {
@@ -0,0 +1,281 @@
+package sftp
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// open flags of the sftp protocol
+const (
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+)
+
+// request builds a request with a raw path, as sftp.NewRequest would clean it.
+func request(method string, p string) *sftp.Request {
+	return &sftp.Request{Method: method, Filepath: p}
+}
+
+// newTestHandler returns a handler confined to the root dir of base, next to a secret file
+// which must never be reachable.
+func newTestHandler(t *testing.T) (*handler, string) {
+	t.Helper()
+
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rootDir := filepath.Join(base, "root")
+	if err := os.Mkdir(rootDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(rootDir, "file.txt"), []byte("file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// links created on the host, e.g. by an app, may point anywhere
+	if err := os.Symlink("..", filepath.Join(rootDir, "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(rootDir, "absolute")); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := os.OpenRoot(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	return &handler{root: root, logger: slog.New(slog.DiscardHandler)}, base
+}
+
+func TestReadConfinedToRoot(t *testing.T) {
+	h, base := newTestHandler(t)
+
+	for _, p := range []string{
+		"../secret.txt",
+		"/../secret.txt",
+		"/root/../../secret.txt",
+		filepath.Join(base, "secret.txt"),
+		"parent/secret.txt",
+		"/parent/secret.txt",
+		"absolute",
+	} {
+		t.Run(p, func(t *testing.T) {
+			r, err := h.Fileread(request("Get", p))
+			if err != nil {
+				return
+			}
+
+			if closer, ok := r.(io.Closer); ok {
+				defer closer.Close()
+			}
+
+			content, _ := io.ReadAll(io.NewSectionReader(r, 0, 1024))
+			if string(content) == "secret" {
+				t.Fatalf("read the secret file through %s", p)
+			}
+		})
+	}
+}
+
+func TestWriteConfinedToRoot(t *testing.T) {
+	h, base := newTestHandler(t)
+
+	for _, p := range []string{
+		"../created.txt",
+		filepath.Join(base, "created.txt"),
+		"parent/created.txt",
+	} {
+		t.Run(p, func(t *testing.T) {
+			req := request("Put", p)
+			req.Flags = sshFxfWrite | sshFxfCreat
+
+			w, err := h.Filewrite(req)
+			if err == nil {
+				w.(io.Closer).Close()
+			}
+
+			if _, err := os.Stat(filepath.Join(base, "created.txt")); err == nil {
+				t.Fatalf("created a file outside of the root through %s", p)
+			}
+		})
+	}
+}
+
+func TestFilecmdConfinedToRoot(t *testing.T) {
+	h, base := newTestHandler(t)
+
+	t.Run("rename", func(t *testing.T) {
+		req := request("Rename", "file.txt")
+		req.Target = "../moved.txt"
+		if err := h.Filecmd(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(base, "moved.txt")); err == nil {
+			t.Fatal("moved a file outside of the root")
+		}
+
+		if _, err := os.Stat(filepath.Join(base, "root", "moved.txt")); err != nil {
+			t.Fatalf("expected the file to be moved within the root: %v", err)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := h.Filecmd(request("Remove", "parent/secret.txt")); err == nil {
+			t.Fatal("removed a file through a symlink")
+		}
+
+		if _, err := os.Stat(filepath.Join(base, "secret.txt")); err != nil {
+			t.Fatalf("secret file is gone: %v", err)
+		}
+	})
+
+	t.Run("mkdir", func(t *testing.T) {
+		_ = h.Filecmd(request("Mkdir", "../../created"))
+		if _, err := os.Stat(filepath.Join(base, "created")); err == nil {
+			t.Fatal("created a dir outside of the root")
+		}
+	})
+
+	t.Run("symlink above root", func(t *testing.T) {
+		// r.Filepath holds the link target, and r.Target the link path
+		req := request("Symlink", "../secret.txt")
+		req.Target = "escape"
+		if err := h.Filecmd(req); err == nil {
+			t.Fatal("created a symlink pointing above the root")
+		}
+	})
+
+	t.Run("absolute symlink", func(t *testing.T) {
+		req := request("Symlink", "/file.txt")
+		req.Target = "dir/link"
+		if err := h.Filecmd(request("Mkdir", "dir")); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Filecmd(req); err != nil {
+			t.Fatal(err)
+		}
+
+		target, err := os.Readlink(filepath.Join(base, "root", "dir", "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if target != filepath.Join("..", "file.txt") {
+			t.Fatalf("expected the target to be relative to the link, got %s", target)
+		}
+	})
+}
+
+func TestListConfinedToRoot(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	for _, p := range []string{"parent", "/parent/", "absolute"} {
+		t.Run(p, func(t *testing.T) {
+			if _, err := h.Filelist(request("List", p)); err == nil {
+				t.Fatalf("listed a dir outside of the root through %s", p)
+			}
+
+			if _, err := h.Filelist(request("Stat", p)); err == nil {
+				t.Fatalf("stat'ed a file outside of the root through %s", p)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	h, base := newTestHandler(t)
+	h.readOnly = true
+
+	if err := h.Filecmd(request("Remove", "file.txt")); err == nil {
+		t.Fatal("removed a file in a read-only session")
+	}
+
+	if _, err := h.Filewrite(request("Put", "new.txt")); err == nil {
+		t.Fatal("wrote a file in a read-only session")
+	}
+
+	if _, err := os.Stat(filepath.Join(base, "root", "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnlyPaths(t *testing.T) {
+	h, base := newTestHandler(t)
+	h.readOnlyPaths = []string{"smallweb.json", ".releases"}
+
+	rootDir := filepath.Join(base, "root")
+	if err := os.WriteFile(filepath.Join(rootDir, "smallweb.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(rootDir, ".releases", "1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("smallweb.json", filepath.Join(rootDir, "config-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"smallweb.json", "/SMALLWEB.JSON", ".releases/1/main.ts", "config-link"} {
+		t.Run("write "+p, func(t *testing.T) {
+			req := request("Put", p)
+			req.Flags = sshFxfWrite | sshFxfCreat
+			if w, err := h.Filewrite(req); err == nil {
+				w.(io.Closer).Close()
+				t.Fatalf("wrote %s", p)
+			}
+		})
+	}
+
+	for _, req := range []*sftp.Request{
+		request("Remove", "smallweb.json"),
+		request("Rmdir", ".releases/1"),
+		request("Mkdir", ".releases/2"),
+		request("Setstat", "smallweb.json"),
+		{Method: "Rename", Filepath: "file.txt", Target: "smallweb.json.tmp/../smallweb.json"},
+		{Method: "Rename", Filepath: ".releases", Target: "releases"},
+		{Method: "Link", Filepath: "smallweb.json", Target: "hardlink"},
+		{Method: "Symlink", Filepath: "file.txt", Target: ".releases/link"},
+	} {
+		t.Run(req.Method+" "+req.Filepath, func(t *testing.T) {
+			if err := h.Filecmd(req); err == nil {
+				t.Fatalf("%s %s -> %s succeeded", req.Method, req.Filepath, req.Target)
+			}
+		})
+	}
+
+	if err := h.PosixRename(&sftp.Request{Method: "PosixRename", Filepath: "file.txt", Target: "smallweb.json"}); err == nil {
+		t.Fatal("replaced a read-only file")
+	}
+
+	if content, err := os.ReadFile(filepath.Join(rootDir, "smallweb.json")); err != nil || string(content) != "{}" {
+		t.Fatalf("read-only file was modified: %q, %v", content, err)
+	}
+
+	// the other files stay writable, and read-only files readable
+	req := request("Put", "other.txt")
+	req.Flags = sshFxfWrite | sshFxfCreat
+	w, err := h.Filewrite(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.(io.Closer).Close()
+
+	r, err := h.Fileread(request("Get", "smallweb.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.(io.Closer).Close()
+}
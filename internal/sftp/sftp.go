@@ -11,18 +11,32 @@ import (
 	"github.com/pkg/sftp"
 )
 
-func SSHOption(rootPath string, logger *slog.Logger) ssh.Option {
+// Permissions restrict what a sftp session can access.
+type Permissions struct {
+	// Root is the directory exposed to the session.
+	Root string
+	// ReadOnly sessions cannot modify files.
+	ReadOnly bool
+	// ReadOnlyPaths are paths relative to the root which cannot be modified, nor the files below
+	// them, e.g. the config of an app.
+	ReadOnlyPaths []string
+}
+
+// Authorizer returns the permissions of a session, or an error if it is not allowed to use sftp.
+type Authorizer func(session ssh.Session) (Permissions, error)
+
+func SSHOption(authorize Authorizer, logger *slog.Logger) ssh.Option {
 	return func(server *ssh.Server) error {
 		if server.SubsystemHandlers == nil {
 			server.SubsystemHandlers = map[string]ssh.SubsystemHandler{}
 		}
 
-		server.SubsystemHandlers["sftp"] = SubsystemHandler(rootPath, logger)
+		server.SubsystemHandlers["sftp"] = SubsystemHandler(authorize, logger)
 		return nil
 	}
 }
 
-func SubsystemHandler(dir string, logger *slog.Logger) ssh.SubsystemHandler {
+func SubsystemHandler(authorize Authorizer, logger *slog.Logger) ssh.SubsystemHandler {
 	return func(session ssh.Session) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -33,24 +47,30 @@ func SubsystemHandler(dir string, logger *slog.Logger) ssh.SubsystemHandler {
 			}
 		}()
 
-		if session.User() != "_" {
-			wish.Errorln(session, "sftp subsystem is only available for the _ user")
+		perms, err := authorize(session)
+		if err != nil {
+			wish.Errorln(session, err)
 			return
 		}
 
-		root, err := os.OpenRoot(dir)
+		root, err := os.OpenRoot(perms.Root)
 		if err != nil {
 			if logger != nil {
 				logger.Error("Error opening root", "err", err)
 			}
 
 			wish.Errorln(session, err)
+			return
 		}
+		defer root.Close()
 
 		handler := &handlererr{
 			Handler: &handler{
-				session: session,
-				root:    root,
+				session:       session,
+				root:          root,
+				readOnly:      perms.ReadOnly,
+				readOnlyPaths: perms.ReadOnlyPaths,
+				logger:        sessionLogger(logger, session),
 			},
 		}
 
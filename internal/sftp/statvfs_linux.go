@@ -0,0 +1,28 @@
+package sftp
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+func statVFS(f *os.File) (*sftp.StatVFS, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Fstatfs(int(f.Fd()), &stat); err != nil {
+		return nil, err
+	}
+
+	return &sftp.StatVFS{
+		Bsize:   uint64(stat.Bsize),
+		Frsize:  uint64(stat.Frsize),
+		Blocks:  stat.Blocks,
+		Bfree:   stat.Bfree,
+		Bavail:  stat.Bavail,
+		Files:   stat.Files,
+		Ffree:   stat.Ffree,
+		Favail:  stat.Ffree,
+		Flag:    uint64(stat.Flags),
+		Namemax: uint64(stat.Namelen),
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package sftp
+
+import (
+	"errors"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+func statVFS(f *os.File) (*sftp.StatVFS, error) {
+	return nil, errors.New("statvfs is not supported on this platform")
+}
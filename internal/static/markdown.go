@@ -0,0 +1,77 @@
+package static
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// markdown renders github flavored markdown. Raw html is kept, as apps serve their own pages.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
+)
+
+// serveMarkdown renders a markdown file as an html page, titled after the title of its front matter.
+func (me *Handler) serveMarkdown(w http.ResponseWriter, r *http.Request, root *os.Root, name string, info fs.FileInfo) {
+	f, err := root.Open(name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	source, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, "could not read file", http.StatusInternalServerError)
+		return
+	}
+
+	title, body := frontMatterTitle(source)
+	var page bytes.Buffer
+	page.WriteString("<!doctype html>\n<meta charset=\"utf-8\">\n<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
+	if title != "" {
+		fmt.Fprintf(&page, "<title>%s</title>\n", html.EscapeString(title))
+	}
+
+	if err := markdown.Convert(body, &page); err != nil {
+		http.Error(w, "could not render markdown", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", etag(info, "md"))
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(page.Bytes()))
+}
+
+// frontMatterTitle strips the front matter of a markdown file, returning the title it sets if any.
+func frontMatterTitle(source []byte) (string, []byte) {
+	content := strings.ReplaceAll(string(source), "\r\n", "\n")
+	rest, ok := strings.CutPrefix(content, "---\n")
+	if !ok {
+		return "", source
+	}
+
+	frontMatter, body, ok := strings.Cut(rest, "\n---\n")
+	if !ok {
+		return "", source
+	}
+
+	var title string
+	for line := range strings.SplitSeq(frontMatter, "\n") {
+		if value, ok := strings.CutPrefix(line, "title:"); ok {
+			title = strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+
+	return title, []byte(body)
+}
@@ -0,0 +1,295 @@
+// Package static serves the files of apps without an entrypoint, without starting deno.
+package static
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Handler serves the files of a directory.
+type Handler struct {
+	dir     string
+	private []string
+	spa     bool
+	listing bool
+}
+
+// Options configures a Handler.
+type Options struct {
+	// Private lists the paths, relative to the served dir, which are never served, e.g. the data dir of the app.
+	Private []string
+	// SPA serves the root index.html for the paths which do not match a file, so that client-side routing works.
+	SPA bool
+	// Listing renders the content of directories without an index.html or index.md.
+	Listing bool
+}
+
+// NewHandler returns a handler serving the files of dir.
+func NewHandler(dir string, opts Options) *Handler {
+	return &Handler{
+		dir:     dir,
+		private: opts.Private,
+		spa:     opts.SPA,
+		listing: opts.Listing,
+	}
+}
+
+// encodings are the precompressed variants looked up for each file, by order of preference.
+var encodings = []struct {
+	name      string
+	extension string
+}{
+	{name: "br", extension: ".br"},
+	{name: "gzip", extension: ".gz"},
+}
+
+func (me *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// files are resolved within the dir, so that symlinks cannot expose files outside of it
+	root, err := os.OpenRoot(me.dir)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer root.Close()
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	name := strings.TrimPrefix(urlPath, "/")
+	if name == "" {
+		name = "."
+	}
+
+	if !me.isPublic(name) {
+		me.notFound(w, r, root)
+		return
+	}
+
+	info, err := root.Stat(name)
+	if err != nil {
+		me.notFound(w, r, root)
+		return
+	}
+
+	if info.IsDir() {
+		// relative links of the index must resolve within the dir
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := urlPath + "/"
+			if urlPath == "/" {
+				target = "/"
+			}
+
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		index := path.Join(name, "index.html")
+		if info, err := root.Stat(index); err == nil && !info.IsDir() {
+			me.serveFile(w, r, root, index, info)
+			return
+		}
+
+		// markdown indexes are rendered, e.g. the www app of new workspaces
+		index = path.Join(name, "index.md")
+		if info, err := root.Stat(index); err == nil && !info.IsDir() {
+			me.serveMarkdown(w, r, root, index, info)
+			return
+		}
+
+		if me.listing {
+			me.serveListing(w, r, root, name, urlPath)
+			return
+		}
+
+		me.notFound(w, r, root)
+		return
+	}
+
+	me.serveFile(w, r, root, name, info)
+}
+
+// privateNames are the files holding the config and secrets of apps, which are never served,
+// wherever they are. Names are compared regardless of case, for case-insensitive filesystems.
+var privateNames = []string{"smallweb.json", "smallweb.jsonc", "secrets.env", "secrets.enc.env"}
+
+// isPublic reports whether a file may be served. Hidden files, e.g. .env or .git, and the
+// config and secrets of the app never are. The .well-known dir is served, as ACME challenges
+// and other well-known uris live in it.
+func (me *Handler) isPublic(name string) bool {
+	if name == "." {
+		return true
+	}
+
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if i == 0 && segment == ".well-known" {
+			continue
+		}
+
+		if strings.HasPrefix(segment, ".") || slices.Contains(privateNames, strings.ToLower(segment)) {
+			return false
+		}
+	}
+
+	// private paths are compared regardless of case too, e.g. Data is the data dir on macOS
+	for _, private := range me.private {
+		privateSegments := strings.Split(private, "/")
+		if len(segments) >= len(privateSegments) && slices.EqualFunc(segments[:len(privateSegments)], privateSegments, strings.EqualFold) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (me *Handler) notFound(w http.ResponseWriter, r *http.Request, root *os.Root) {
+	// client-side routes have no extension, missing assets must still fail
+	if me.spa && path.Ext(r.URL.Path) == "" {
+		if info, err := root.Stat("index.html"); err == nil && !info.IsDir() {
+			me.serveFile(w, r, root, "index.html", info)
+			return
+		}
+	}
+
+	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+func (me *Handler) serveFile(w http.ResponseWriter, r *http.Request, root *os.Root, name string, info fs.FileInfo) {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	for _, encoding := range encodings {
+		if !acceptsEncoding(r, encoding.name) {
+			continue
+		}
+
+		encodedInfo, err := root.Stat(name + encoding.extension)
+		if err != nil || encodedInfo.IsDir() {
+			continue
+		}
+
+		f, err := root.Open(name + encoding.extension)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Encoding", encoding.name)
+		w.Header().Set("ETag", etag(encodedInfo, encoding.name))
+		http.ServeContent(w, r, name, encodedInfo.ModTime(), f)
+		return
+	}
+
+	f, err := root.Open(name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", etag(info, ""))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// etag identifies a version of a file from its size and modification time, as hashing
+// the content would require reading the whole file on each request.
+func etag(info fs.FileInfo, encoding string) string {
+	tag := fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+
+	return `"` + tag + `"`
+}
+
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for part := range strings.SplitSeq(value, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+				continue
+			}
+
+			// q=0 explicitly refuses the encoding
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (me *Handler) serveListing(w http.ResponseWriter, r *http.Request, root *os.Root, name string, urlPath string) {
+	f, err := root.Open(name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		http.Error(w, "could not read directory", http.StatusInternalServerError)
+		return
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	var sb strings.Builder
+	title := html.EscapeString(strings.TrimSuffix(urlPath, "/") + "/")
+	fmt.Fprintf(&sb, "<!doctype html>\n<meta charset=\"utf-8\">\n<title>Index of %s</title>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	if urlPath != "/" {
+		sb.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if !me.isPublic(path.Join(strings.TrimPrefix(name, "."), entryName)) {
+			continue
+		}
+
+		if entry.IsDir() {
+			entryName += "/"
+		}
+
+		// names containing a colon would otherwise be read as a scheme
+		href := (&url.URL{Path: entryName}).String()
+		fmt.Fprintf(&sb, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	sb.WriteString("</ul>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, _ = w.Write([]byte(sb.String()))
+}
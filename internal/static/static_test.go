@@ -0,0 +1,168 @@
+package static
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestHandler serves a dir holding public files next to the config and secrets of the app.
+func newTestHandler(t *testing.T, opts Options) *Handler {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":                       "index",
+		"smallweb.json":                    "{}",
+		"smallweb.jsonc":                   "{}",
+		"secrets.env":                      "SECRET=1",
+		"secrets.enc.env":                  "SECRET=ENC[...]",
+		".env":                             "SECRET=1",
+		".git/config":                      "[core]",
+		"data/db.sqlite":                   "db",
+		"nested/smallweb.json":             "{}",
+		".well-known/acme-challenge/token": "challenge",
+		".well-known/security.txt":         "contact",
+		".well-known/.hidden":              "hidden",
+		"assets/app.js":                    "app",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewHandler(dir, opts)
+}
+
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestPrivateFiles(t *testing.T) {
+	h := newTestHandler(t, Options{Private: []string{"data"}, SPA: true})
+
+	for _, target := range []string{
+		"/smallweb.json",
+		"/smallweb.jsonc",
+		"/secrets.env",
+		"/secrets.enc.env",
+		"/SMALLWEB.JSON",
+		"/nested/smallweb.json",
+		"/.env",
+		"/.git/config",
+		"/data/db.sqlite",
+		"/Data/db.sqlite",
+		"/.well-known/.hidden",
+		"/assets/../secrets.env",
+	} {
+		t.Run(target, func(t *testing.T) {
+			w := get(h, target)
+			if w.Code == http.StatusOK && w.Body.String() != "index" {
+				t.Fatalf("served %s: %q", target, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPrivateDirsIgnoreCase(t *testing.T) {
+	// case-insensitive filesystems resolve any case to the private dir
+	h := NewHandler(t.TempDir(), Options{Private: []string{"data", "config/keys"}})
+
+	for name, expected := range map[string]bool{
+		"data":                false,
+		"DATA/db.sqlite":      false,
+		"Data/nested/file":    false,
+		"Config/KEYS/key.pem": false,
+		"database/file":       true,
+		"config/public.json":  true,
+		"assets/data":         true,
+	} {
+		if public := h.isPublic(name); public != expected {
+			t.Errorf("%s: expected public to be %v", name, expected)
+		}
+	}
+}
+
+func TestWellKnown(t *testing.T) {
+	h := newTestHandler(t, Options{})
+
+	for target, expected := range map[string]string{
+		"/.well-known/acme-challenge/token": "challenge",
+		"/.well-known/security.txt":         "contact",
+		"/assets/app.js":                    "app",
+	} {
+		t.Run(target, func(t *testing.T) {
+			w := get(h, target)
+			if w.Code != http.StatusOK || w.Body.String() != expected {
+				t.Fatalf("expected %q, got %d: %q", expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestListingHidesPrivateFiles(t *testing.T) {
+	h := newTestHandler(t, Options{Listing: true})
+	if err := os.Remove(filepath.Join(h.dir, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := get(h, "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a listing, got %d", w.Code)
+	}
+
+	for _, name := range []string{"smallweb.json", "secrets.env", "secrets.enc.env", ".env", ".git"} {
+		if strings.Contains(w.Body.String(), ">"+name) {
+			t.Errorf("listing shows %s", name)
+		}
+	}
+
+	if !strings.Contains(w.Body.String(), ">assets/") {
+		t.Errorf("listing does not show public dirs: %s", w.Body.String())
+	}
+}
+
+func TestMarkdownIndex(t *testing.T) {
+	// the www app of new workspaces only holds an index.md
+	h := NewHandler(filepath.Join("..", "cmd", "templates", "workspace", "www"), Options{})
+
+	w := get(h, "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the index to be rendered, got %d", w.Code)
+	}
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("expected an html page, got %s", contentType)
+	}
+
+	body := w.Body.String()
+	for _, expected := range []string{"<title>Welcome to Smallweb!</title>", "<h1>Welcome to smallweb</h1>", "<code>www/index.md</code>"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the page to contain %s, got %s", expected, body)
+		}
+	}
+
+	if strings.Contains(body, "title:") {
+		t.Errorf("expected the front matter to be stripped, got %s", body)
+	}
+
+	// html indexes take precedence
+	h = newTestHandler(t, Options{})
+	if err := os.WriteFile(filepath.Join(h.dir, "index.md"), []byte("# markdown"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := get(h, "/"); w.Body.String() != "index" {
+		t.Errorf("expected index.html to be served, got %q", w.Body.String())
+	}
+}
@@ -19,6 +19,7 @@ type Watcher struct {
 	mu           sync.Mutex
 	reloadConfig func()
 	mtimes       map[string]time.Time
+	changedAt    time.Time
 	root         string
 }
 
@@ -51,13 +52,32 @@ func (me *Watcher) Start() error {
 			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) && !event.Has(fsnotify.Remove) {
 				continue
 			}
-			fileinfo, err := os.Stat(event.Name)
+
+			// removed apps cannot be stat'ed, so any change to an app or to the config is recorded first
+			if rel, err := filepath.Rel(me.root, event.Name); err == nil {
+				if name, _, _ := strings.Cut(rel, string(filepath.Separator)); !strings.HasPrefix(name, ".") || event.Name == utils.FindConfigPath(me.root) {
+					me.mu.Lock()
+					me.changedAt = time.Now()
+					me.mu.Unlock()
+				}
+			}
+			// release pointers are symlinks, their flips must be reported as changes
+			fileinfo, err := os.Lstat(event.Name)
 			if err != nil {
 				continue
 			}
 			if fileinfo.IsDir() {
 				if event.Has(fsnotify.Create) {
 					_ = me.AddDir(event.Name)
+
+					// dirs may be moved in place at once, e.g. when importing an app or restoring its data
+					if rel, err := filepath.Rel(me.root, event.Name); err == nil {
+						if name, _, _ := strings.Cut(rel, string(filepath.Separator)); !strings.HasPrefix(name, ".") {
+							me.mu.Lock()
+							me.mtimes[name] = time.Now()
+							me.mu.Unlock()
+						}
+					}
 				}
 				continue
 			}
@@ -130,7 +150,25 @@ func (me *Watcher) GetAppMtime(app string) time.Time {
 	return mtime
 }
 
+// ChangedAt returns the time of the last change to the apps or to the config.
+func (me *Watcher) ChangedAt() time.Time {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	return me.changedAt
+}
+
 func (me *Watcher) AddDir(dir string) error {
+	// releases are immutable
+	if filepath.Base(dir) == app.ReleasesDirName || filepath.Base(filepath.Dir(dir)) == app.ReleasesDirName {
+		return nil
+	}
+
+	// data dirs are written by the apps themselves
+	if dir != me.root && filepath.Dir(dir) != me.root && (filepath.Base(dir) == "data" || filepath.Base(dir) == "node_modules") {
+		return nil
+	}
+
 	if err := me.watcher.Add(dir); err != nil {
 		return err
 	}
@@ -144,7 +182,7 @@ func (me *Watcher) AddDir(dir string) error {
 		}
 
 		name := filepath.Base(path)
-		if name == ".git" {
+		if name == ".git" || name == app.ReleasesDirName {
 			return filepath.SkipDir
 		}
 
@@ -0,0 +1,282 @@
+package worker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pomdtr/smallweb/internal/app"
+)
+
+const cgroupMount = "/sys/fs/cgroup"
+
+// cgroups describes where the cgroups of deno processes are created.
+type cgroups struct {
+	parent string
+	// leaf is the cgroup smallweb moved itself to, if it had to leave its own one.
+	leaf string
+}
+
+// cgroupParent returns the cgroup under which a cgroup is created for each deno process.
+var cgroupParent = sync.OnceValues(setupCgroups)
+
+// logCgroupMove logs the move of smallweb to a leaf cgroup once, as it is not obvious from outside.
+var logCgroupMove sync.Once
+
+// setupCgroups delegates the memory, cpu and pids controllers of the cgroup of smallweb to its children.
+// Controllers can only be delegated by cgroups without processes, so unless smallweb runs in the root
+// cgroup, it moves itself to a "smallweb" leaf cgroup, e.g. /system.slice/smallweb.service/smallweb
+// when run by systemd. Tools reading the cgroup of the smallweb process will find it there.
+func setupCgroups() (cgroups, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return cgroups{}, errors.New("cgroup v2 is not mounted")
+	}
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return cgroups{}, err
+	}
+
+	var current string
+	for line := range strings.SplitSeq(strings.TrimSpace(string(data)), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			current = path
+		}
+	}
+
+	if current == "" {
+		return cgroups{}, errors.New("could not find the cgroup of smallweb")
+	}
+
+	parent := filepath.Join(cgroupMount, current)
+	var leaf string
+	if current == "/" {
+		// processes are allowed in the root cgroup, but workers should not pollute it
+		if err := enableControllers(parent); err != nil {
+			return cgroups{}, err
+		}
+
+		parent = filepath.Join(parent, "smallweb")
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return cgroups{}, err
+		}
+	} else {
+		leaf = filepath.Join(parent, "smallweb")
+		if err := os.MkdirAll(leaf, 0755); err != nil {
+			return cgroups{}, err
+		}
+
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte("0"), 0644); err != nil {
+			return cgroups{}, fmt.Errorf("could not move smallweb to %s: %w", leaf, err)
+		}
+	}
+
+	if err := enableControllers(parent); err != nil {
+		return cgroups{}, err
+	}
+
+	return cgroups{parent: parent, leaf: leaf}, nil
+}
+
+func enableControllers(dir string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	var controllers []string
+	for _, controller := range strings.Fields(string(available)) {
+		switch controller {
+		case "memory", "cpu", "pids":
+			controllers = append(controllers, "+"+controller)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644); err != nil {
+		return fmt.Errorf("could not enable cgroup controllers: %w", err)
+	}
+
+	return nil
+}
+
+// limiter enforces the resource limits of a deno process.
+type limiter struct {
+	limits   app.Limits
+	cgroup   string
+	cgroupFD *os.File
+	err      error
+}
+
+func newLimiter(appname string, limits app.Limits, logger *slog.Logger) *limiter {
+	l := &limiter{limits: limits}
+	if limits.Memory == 0 && limits.CPU == 0 && limits.Processes == 0 {
+		return l
+	}
+
+	cgroups, err := cgroupParent()
+	if err != nil {
+		l.err = err
+		return l
+	}
+
+	if cgroups.leaf != "" && logger != nil {
+		logCgroupMove.Do(func() {
+			logger.Info("moved smallweb to a leaf cgroup, to delegate resource controllers to deno processes", "cgroup", strings.TrimPrefix(cgroups.leaf, cgroupMount))
+		})
+	}
+
+	dir, err := os.MkdirTemp(cgroups.parent, appname+"-")
+	if err != nil {
+		l.err = err
+		return l
+	}
+	l.cgroup = dir
+
+	settings := map[string]string{}
+	if limits.Memory > 0 {
+		settings["memory.max"] = strconv.Itoa(limits.Memory * 1024 * 1024)
+		settings["memory.swap.max"] = "0"
+	}
+
+	if limits.CPU > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d 100000", int(limits.CPU*100000))
+	}
+
+	if limits.Processes > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.Processes)
+	}
+
+	for name, value := range settings {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil && !(name == "memory.swap.max" && errors.Is(err, os.ErrNotExist)) {
+			l.release()
+			l.err = fmt.Errorf("could not set %s: %w", name, err)
+			return l
+		}
+	}
+
+	return l
+}
+
+// start starts the command within the limits.
+func (me *limiter) start(command *exec.Cmd) error {
+	if err := me.apply(command); err != nil {
+		return err
+	}
+
+	return command.Start()
+}
+
+// apply makes the command run within the limits once started. The cgroup is kept open until the limiter is released.
+func (me *limiter) apply(command *exec.Cmd) error {
+	if me.cgroup != "" {
+		// the process is started directly in its cgroup, so that no allocation escapes the limits
+		fd, err := os.Open(me.cgroup)
+		if err != nil {
+			return err
+		}
+		me.cgroupFD = fd
+
+		if command.SysProcAttr == nil {
+			command.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		command.SysProcAttr.UseCgroupFD = true
+		command.SysProcAttr.CgroupFD = int(fd.Fd())
+	}
+
+	if me.limits.Files > 0 {
+		// the limit is set by the process itself before exec'ing deno, so that no file is opened before it applies
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		command.Args = append([]string{executable, LimitExecCommand, strconv.Itoa(me.limits.Files), "--", command.Path}, command.Args[1:]...)
+		command.Path = executable
+	}
+
+	return nil
+}
+
+// LimitExec limits the open files of the current process, and replaces it with the command.
+func LimitExec(files int, argv []string) error {
+	// syscall.Setrlimit also prevents the runtime from restoring the previous limit on exec
+	limit := &syscall.Rlimit{Cur: uint64(files), Max: uint64(files)}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, limit); err != nil {
+		return fmt.Errorf("could not limit open files: %w", err)
+	}
+
+	return syscall.Exec(argv[0], argv, os.Environ())
+}
+
+// memoryUsage returns the memory used by the process, if it runs in a cgroup.
+func (me *limiter) memoryUsage() (int64, bool) {
+	if me.cgroup == "" {
+		return 0, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(me.cgroup, "memory.current"))
+	if err != nil {
+		return 0, false
+	}
+
+	usage, err := strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return usage, true
+}
+
+// oomKilled reports whether the process was killed for exceeding its memory limit.
+func (me *limiter) oomKilled() bool {
+	if me.cgroup == "" {
+		return false
+	}
+
+	data, err := os.ReadFile(filepath.Join(me.cgroup, "memory.events"))
+	if err != nil {
+		return false
+	}
+
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if count, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			return count != "0"
+		}
+	}
+
+	return false
+}
+
+// release kills the processes left in the cgroup, and removes it.
+func (me *limiter) release() {
+	if me.cgroupFD != nil {
+		me.cgroupFD.Close()
+		me.cgroupFD = nil
+	}
+
+	if me.cgroup == "" {
+		return
+	}
+
+	_ = os.WriteFile(filepath.Join(me.cgroup, "cgroup.kill"), []byte("1"), 0644)
+
+	// the cgroup can only be removed once its processes exited
+	for range 50 {
+		if err := os.Remove(me.cgroup); err == nil || errors.Is(err, os.ErrNotExist) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	me.cgroup = ""
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+
+package worker
+
+import (
+	"errors"
+	"log/slog"
+	"os/exec"
+
+	"github.com/pomdtr/smallweb/internal/app"
+)
+
+// limiter enforces the resource limits of a deno process. Only the V8 heap limit,
+// which is passed as a flag, is supported outside of linux.
+type limiter struct {
+	err error
+}
+
+func newLimiter(appname string, limits app.Limits, logger *slog.Logger) *limiter {
+	if limits.CPU == 0 && limits.Files == 0 && limits.Processes == 0 {
+		return &limiter{}
+	}
+
+	return &limiter{err: errors.New("cpu, files and processes limits are only supported on linux")}
+}
+
+func (me *limiter) start(command *exec.Cmd) error {
+	return command.Start()
+}
+
+func (me *limiter) apply(command *exec.Cmd) error {
+	return nil
+}
+
+// LimitExec is only used on linux.
+func LimitExec(files int, argv []string) error {
+	return errors.New("files limits are only supported on linux")
+}
+
+func (me *limiter) memoryUsage() (int64, bool) {
+	return 0, false
+}
+
+func (me *limiter) oomKilled() bool {
+	return false
+}
+
+func (me *limiter) release() {}
@@ -0,0 +1,132 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// transport pools the connections to a deno server. HTTP/2 requests which rely on HTTP/2
+// semantics, e.g. gRPC ones, are forwarded over cleartext HTTP/2, the others over HTTP/1.1.
+type transport struct {
+	http1 *http.Transport
+	http2 *http.Transport
+}
+
+func (me *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.ProtoMajor == 2 && needsHTTP2(r) {
+		return me.http2.RoundTrip(r)
+	}
+
+	return me.http1.RoundTrip(r)
+}
+
+// needsHTTP2 reports whether a request can only be served over HTTP/2: gRPC requests, which
+// stream their body while reading the response, and requests sending or expecting trailers.
+func needsHTTP2(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		return true
+	}
+
+	return len(r.Trailer) > 0 || httpguts.HeaderValuesContainsToken(r.Header["Te"], "trailers")
+}
+
+func (me *transport) CloseIdleConnections() {
+	me.http1.CloseIdleConnections()
+	me.http2.CloseIdleConnections()
+}
+
+// newProxy returns a reverse proxy to the deno server listening on socketPath.
+func (me *Worker) newProxy(socketPath string) (*httputil.ReverseProxy, *transport) {
+	headerTimeout := defaultHeaderTimeout
+	if me.Requests.HeaderTimeout > 0 {
+		headerTimeout = time.Duration(me.Requests.HeaderTimeout) * time.Second
+	}
+
+	newTransport := func(protocols *http.Protocols) *http.Transport {
+		return &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: 30 * time.Second}).DialContext(ctx, "unix", socketPath)
+			},
+			Protocols: protocols,
+			// all connections go to the same host
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   100,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: headerTimeout,
+			// the response is forwarded as is, the client decides on the encoding
+			DisableCompression: true,
+		}
+	}
+
+	var http1, http2 http.Protocols
+	http1.SetHTTP1(true)
+	http2.SetUnencryptedHTTP2(true)
+	transport := &transport{
+		http1: newTransport(&http1),
+		http2: newTransport(&http2),
+	}
+
+	target := &url.URL{Scheme: "http", Host: "localhost"}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+
+			// smallweb may itself run behind a proxy
+			r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
+			r.SetXForwarded()
+			for _, header := range []string{"X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if value := r.In.Header.Get(header); value != "" {
+					r.Out.Header.Set(header, value)
+				}
+			}
+		},
+		Transport:  transport,
+		BufferPool: bufferPool{},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var maxBytesErr *http.MaxBytesError
+			var netErr net.Error
+			switch {
+			case errors.As(err, &maxBytesErr):
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			case errors.Is(r.Context().Err(), context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+				http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			case errors.Is(err, context.Canceled):
+				// the client went away
+			default:
+				if me.Logger != nil {
+					me.Logger.Error("could not reach the server", "error", err)
+				}
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			}
+		},
+	}
+
+	return proxy, transport
+}
+
+var buffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// bufferPool shares the buffers used to copy response bodies between requests.
+type bufferPool struct{}
+
+func (bufferPool) Get() []byte {
+	return *buffers.Get().(*[]byte)
+}
+
+func (bufferPool) Put(buf []byte) {
+	buffers.Put(&buf)
+}
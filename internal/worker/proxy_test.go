@@ -0,0 +1,142 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves a static response on a unix socket, as a deno server would.
+func startServer(b *testing.B, size int) string {
+	b.Helper()
+
+	socketPath := filepath.Join(b.TempDir(), "deno.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	body := strings.Repeat("x", size)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, body)
+	})}
+
+	go server.Serve(ln)
+	b.Cleanup(func() { server.Close() })
+
+	return socketPath
+}
+
+func BenchmarkProxy(b *testing.B) {
+	for _, size := range []int{1024, 64 * 1024} {
+		socketPath := startServer(b, size)
+		proxy, transport := (&Worker{}).newProxy(socketPath)
+		b.Cleanup(transport.CloseIdleConnections)
+
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w := httptest.NewRecorder()
+					proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://app.localhost/", nil))
+					if w.Code != http.StatusOK || w.Body.Len() != size {
+						b.Fatalf("unexpected response: %d, %d bytes", w.Code, w.Body.Len())
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkProxyPerRequestClient forwards requests the way workers did before using a
+// reverse proxy: a new client for each request, and a flush after each read.
+func BenchmarkProxyPerRequestClient(b *testing.B) {
+	for _, size := range []int{1024, 64 * 1024} {
+		socketPath := startServer(b, size)
+
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w := httptest.NewRecorder()
+					forward(w, httptest.NewRequest(http.MethodGet, "http://app.localhost/", nil), socketPath)
+					if w.Code != http.StatusOK || w.Body.Len() != size {
+						b.Fatalf("unexpected response: %d, %d bytes", w.Code, w.Body.Len())
+					}
+				}
+			})
+		})
+	}
+}
+
+func forward(w http.ResponseWriter, r *http.Request, socketPath string) {
+	request, err := http.NewRequestWithContext(r.Context(), r.Method, "http://localhost"+r.URL.String(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for k, v := range r.Header {
+		for _, vv := range v {
+			request.Header.Add(k, vv)
+		}
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: 5 * time.Minute}).DialContext(ctx, "unix", socketPath)
+			},
+			ResponseHeaderTimeout: defaultHeaderTimeout,
+		},
+	}
+
+	// unlike workers, the benchmark closes the connections, so that it does not run out of files
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		for _, vv := range v {
+			w.Header().Add(k, vv)
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func byteSize(size int) string {
+	return fmt.Sprintf("%dKiB", size/1024)
+}
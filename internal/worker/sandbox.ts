@@ -8,7 +8,7 @@ if (!payload || !payload.method) {
 if (payload.method === "fetch") {
     Deno.serve(
         {
-            port: parseInt(payload.port),
+            path: payload.path,
             onListen: () => {
                 // This line will signal that the server is ready to the go
                 console.error("READY");
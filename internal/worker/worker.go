@@ -9,19 +9,20 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/adrg/xdg"
-	"github.com/gorilla/websocket"
 	"github.com/pomdtr/smallweb/internal/app"
+	"github.com/pomdtr/smallweb/internal/compress"
+	"github.com/pomdtr/smallweb/internal/sandbox"
 	"github.com/pomdtr/smallweb/internal/utils"
 )
 
@@ -29,17 +30,24 @@ import (
 var sandboxBytes []byte
 var sandboxPath string
 
+// socketRoot holds the sockets of the deno servers, out of reach of other local users.
+var socketRoot = sync.OnceValues(func() (string, error) {
+	return os.MkdirTemp("", "smallweb-sockets-*")
+})
+
 func init() {
 	tempdir, err := os.MkdirTemp("", "smallweb-sandbox-*")
 	if err != nil {
 		panic(fmt.Errorf("could not create temp directory for sandbox: %w", err))
 	}
 
-	sandboxPath = filepath.Join(tempdir, "sandbox.ts")
-	if err := os.MkdirAll(filepath.Dir(sandboxPath), 0o755); err != nil {
+	// sandboxed apps run as their own user, and must be able to read the script
+	if err := os.Chmod(tempdir, 0o755); err != nil {
 		panic(fmt.Errorf("could not create sandbox directory: %w", err))
 	}
 
+	sandboxPath = filepath.Join(tempdir, "sandbox.ts")
+
 	if err := os.WriteFile(sandboxPath, sandboxBytes, 0o644); err != nil {
 		panic(fmt.Errorf("could not write sandbox file: %w", err))
 	}
@@ -49,23 +57,47 @@ type Worker struct {
 	App       app.App
 	StartedAt time.Time
 	Logger    *slog.Logger
-
-	port           int
+	// Limits defaults to the limits set in the config of the app.
+	Limits app.Limits
+	// Requests defaults to the request limits set in the config of the app.
+	Requests app.Requests
+	// Sandbox runs the deno processes of the app as a dedicated user, only seeing its own files.
+	Sandbox bool
+
+	socketDir      string
 	idleTimer      *time.Timer
 	command        *exec.Cmd
+	limiter        *limiter
+	handler        http.Handler
+	transport      *transport
+	exited         chan struct{}
 	activeRequests atomic.Int32
 }
 
 func NewWorker(app app.App, logger *slog.Logger) *Worker {
 	worker := &Worker{
-		App:    app,
-		Logger: logger,
+		App:      app,
+		Logger:   logger,
+		Limits:   app.Config.Limits,
+		Requests: app.Config.Requests,
 	}
 
 	return worker
 }
 
-var upgrader = websocket.Upgrader{} // use default options
+// defaultHeaderTimeout is the wait for the response headers of apps which do not set one.
+const defaultHeaderTimeout = 5 * time.Minute
+
+// heapSize returns the size of the V8 heap in MiB for a memory limit. The rest of the limit is left to
+// the memory used outside of the heap, e.g. by buffers, wasm and deno itself, so that V8 collects
+// garbage before the process gets killed.
+func heapSize(memory int) int {
+	return max(memory*3/4, 1)
+}
+
+// LimitExecCommand is the hidden smallweb command applying the limits of a process which can
+// only be set from within it, before running deno.
+const LimitExecCommand = "limit-exec"
 
 type SandboxMethod string
 
@@ -78,9 +110,14 @@ func (me *Worker) Args(payload string) []string {
 		"--allow-sys",
 		"--no-prompt",
 		"--quiet",
-		sandboxPath,
 	}
 
+	if me.Limits.Memory > 0 {
+		args = append(args, fmt.Sprintf("--v8-flags=--max-old-space-size=%d", heapSize(me.Limits.Memory)))
+	}
+
+	args = append(args, sandboxPath)
+
 	for _, configName := range []string{"deno.json", "deno.jsonc"} {
 		configPath := filepath.Join(me.App.Dir(), configName)
 		if _, err := os.Stat(configPath); err == nil {
@@ -92,10 +129,31 @@ func (me *Worker) Args(payload string) []string {
 	npmCache := filepath.Join(xdg.CacheHome, "deno", "npm", "registry.npmjs.org")
 	// if root is not a symlink
 	appDir := me.App.Dir()
+	readPaths := []string{appDir, npmCache}
+	writePaths := []string{filepath.Join(appDir, "data")}
+
+	// releases link to the data dir shared by the app
+	if dataDir, err := filepath.EvalSymlinks(filepath.Join(appDir, "data")); err == nil && dataDir != filepath.Join(appDir, "data") {
+		readPaths = append(readPaths, dataDir)
+		writePaths = append(writePaths, dataDir)
+	}
+
+	// the database managed by smallweb lives in the data dir of the app, which may not be the root of the app
+	if dbDir := filepath.Dir(me.App.DatabasePath()); !slices.Contains(writePaths, dbDir) {
+		readPaths = append(readPaths, dbDir)
+		writePaths = append(writePaths, dbDir)
+	}
+
+	// the server listens on a unix socket in its own dir
+	if me.socketDir != "" {
+		readPaths = append(readPaths, me.socketDir)
+		writePaths = append(writePaths, me.socketDir)
+	}
+
 	args = append(
 		args,
-		fmt.Sprintf("--allow-read=%s,%s", appDir, npmCache),
-		fmt.Sprintf("--allow-write=%s", filepath.Join(appDir, "data")),
+		fmt.Sprintf("--allow-read=%s", strings.Join(readPaths, ",")),
+		fmt.Sprintf("--allow-write=%s", strings.Join(writePaths, ",")),
 	)
 
 	args = append(args, payload)
@@ -103,12 +161,40 @@ func (me *Worker) Args(payload string) []string {
 	return args
 }
 
+// createDataDir creates the dir of the database managed by smallweb, as sqlite can only
+// create the database if its dir exists.
+func (me *Worker) createDataDir() error {
+	if err := os.MkdirAll(filepath.Dir(me.App.DatabasePath()), 0755); err != nil {
+		return fmt.Errorf("could not create data dir: %w", err)
+	}
+
+	return nil
+}
+
 func (me *Worker) StartServer() error {
-	port, err := GetFreePort()
+	if err := me.createDataDir(); err != nil {
+		return err
+	}
+
+	// each server gets a fresh dir, as the previous server of the app may still be shutting down
+	root, err := socketRoot()
 	if err != nil {
-		return fmt.Errorf("could not get free port: %w", err)
+		return fmt.Errorf("could not create socket root: %w", err)
 	}
-	me.port = port
+
+	socketDir, err := os.MkdirTemp(root, "")
+	if err != nil {
+		return fmt.Errorf("could not create socket dir: %w", err)
+	}
+	me.socketDir = socketDir
+	socketPath := filepath.Join(socketDir, "deno.sock")
+
+	started := false
+	defer func() {
+		if !started {
+			_ = os.RemoveAll(socketDir)
+		}
+	}()
 
 	deno, err := DenoExecutable()
 	if err != nil {
@@ -121,7 +207,7 @@ func (me *Worker) StartServer() error {
 	if err := encoder.Encode(map[string]any{
 		"entrypoint": me.App.Entrypoint(),
 		"method":     "fetch",
-		"port":       port,
+		"path":       socketPath,
 	}); err != nil {
 		return fmt.Errorf("could not encode input: %w", err)
 	}
@@ -130,6 +216,9 @@ func (me *Worker) StartServer() error {
 	command := exec.Command(deno, args...)
 	command.Dir = me.App.Dir()
 	command.Env = me.App.Env()
+	if err := me.isolate(command); err != nil {
+		return fmt.Errorf("could not sandbox server: %w", err)
+	}
 
 	stdoutPipe, err := command.StdoutPipe()
 	if err != nil {
@@ -141,9 +230,28 @@ func (me *Worker) StartServer() error {
 		return fmt.Errorf("could not get stderr pipe: %w", err)
 	}
 
-	if err := command.Start(); err != nil {
+	limiter := newLimiter(me.App.Name, me.Limits, me.Logger)
+	if limiter.err != nil && me.Logger != nil {
+		me.Logger.Warn("some resource limits are not enforced", "error", limiter.err)
+	}
+
+	if err := limiter.start(command); err != nil {
+		limiter.release()
 		return fmt.Errorf("could not start server: %w", err)
 	}
+	started = true
+
+	exited := make(chan struct{})
+	go func() {
+		_ = command.Wait()
+		if limiter.oomKilled() && me.Logger != nil {
+			me.Logger.Error("server killed for exceeding its memory limit", "memory", fmt.Sprintf("%dMiB", me.Limits.Memory))
+		}
+
+		limiter.release()
+		_ = os.RemoveAll(socketDir)
+		close(exited)
+	}()
 
 	readyChan := make(chan bool)
 	go func() {
@@ -163,9 +271,11 @@ func (me *Worker) StartServer() error {
 	select {
 	case ready := <-readyChan:
 		if !ready {
+			_ = command.Process.Kill()
 			return fmt.Errorf("server did not start correctly")
 		}
 	case <-time.After(30 * time.Second):
+		_ = command.Process.Kill()
 		return fmt.Errorf("server start timed out")
 	}
 
@@ -195,6 +305,16 @@ func (me *Worker) StartServer() error {
 	go logPipe(stderrPipe, "stderr")
 
 	me.command = command
+	me.limiter = limiter
+	proxy, transport := me.newProxy(socketPath)
+	me.handler, me.transport = proxy, transport
+	if compression := me.App.Config.Compression; !compression.Disabled {
+		me.handler = compress.Handler(proxy, compress.Options{
+			Encodings: compression.Encodings,
+			MinSize:   compression.MinSize,
+		})
+	}
+	me.exited = exited
 	me.StartedAt = time.Now()
 	me.idleTimer = time.NewTimer(10 * time.Second)
 	go me.monitorIdleTimer()
@@ -203,7 +323,30 @@ func (me *Worker) StartServer() error {
 }
 
 func (me *Worker) IsRunning() bool {
-	return me.command != nil
+	if me.command == nil {
+		return false
+	}
+
+	// the server may have been killed, e.g. for exceeding its memory limit
+	select {
+	case <-me.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// MemoryUsage returns the memory used by the server, when it is tracked by a cgroup.
+func (me *Worker) MemoryUsage() (int64, bool) {
+	if !me.IsRunning() {
+		return 0, false
+	}
+
+	return me.limiter.memoryUsage()
+}
+
+func (me *Worker) ActiveRequests() int {
+	return int(me.activeRequests.Load())
 }
 
 func (me *Worker) Stop() error {
@@ -213,23 +356,26 @@ func (me *Worker) Stop() error {
 
 	command := me.command
 	me.command = nil
+	me.transport.CloseIdleConnections()
+
+	exited := me.exited
+	select {
+	case <-exited:
+		return nil
+	default:
+	}
 
 	if err := command.Process.Signal(os.Interrupt); err != nil {
 		return fmt.Errorf("failed to send interrupt signal: %w", err)
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- command.Wait()
-	}()
-
 	select {
 	case <-time.After(5 * time.Second):
 		if err := command.Process.Kill(); err != nil {
 			return fmt.Errorf("failed to kill process: %w", err)
 		}
 		return fmt.Errorf("process did not exit after 5 seconds")
-	case <-done:
+	case <-exited:
 		return nil
 	}
 }
@@ -252,147 +398,28 @@ func (me *Worker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		me.activeRequests.Add(-1)
 	}()
 
-	// handle websockets
-	if r.Header.Get("Upgrade") == "websocket" {
-		serverConn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer serverConn.Close()
-
-		clientConn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d%s", me.port, r.URL.Path), nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer clientConn.Close()
+	// upgraded connections, e.g. websockets, outlive the request and stream both ways
+	upgrade := r.Header.Get("Upgrade") != ""
 
-		ctx, cancel := context.WithCancel(r.Context())
+	ctx := r.Context()
+	if me.Requests.Timeout > 0 && !upgrade {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(me.Requests.Timeout)*time.Second)
 		defer cancel()
-
-		// Channel to signal closure
-		var wg sync.WaitGroup
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					messageType, p, err := clientConn.ReadMessage()
-					if err != nil {
-						return
-					}
-
-					if err := serverConn.WriteMessage(messageType, p); err != nil {
-						return
-					}
-				}
-			}
-		}()
-
-		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					messageType, p, err := serverConn.ReadMessage()
-					if err != nil {
-						return
-					}
-
-					if err := clientConn.WriteMessage(messageType, p); err != nil {
-						return
-					}
-				}
-			}
-		}()
-
-		wg.Wait()
-		return
-	}
-
-	request, err := http.NewRequestWithContext(r.Context(), r.Method, fmt.Sprintf("http://127.0.0.1:%d%s", me.port, r.URL.String()), r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	for k, v := range r.Header {
-		for _, vv := range v {
-			request.Header.Add(k, vv)
-		}
 	}
 
-	if request.Header.Get("x-forwarded-host") == "" {
-		request.Header.Set("x-forwarded-host", r.Host)
-	}
-
-	if request.Header.Get("x-forwarded-proto") == "" {
-		if r.TLS != nil {
-			request.Header.Set("x-forwarded-proto", "https")
-		} else {
-			request.Header.Set("x-forwarded-proto", "http")
-		}
-	}
-
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   5 * time.Minute,
-				KeepAlive: 5 * time.Minute,
-			}).DialContext,
-			TLSHandshakeTimeout:   5 * time.Minute,
-			ResponseHeaderTimeout: 5 * time.Minute,
-		},
-	}
-
-	resp, err := client.Do(request)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	for k, v := range resp.Header {
-		for _, vv := range v {
-			w.Header().Add(k, vv)
+	if me.Requests.MaxBodySize > 0 && !upgrade {
+		maxBodySize := int64(me.Requests.MaxBodySize) * 1024 * 1024
+		if r.ContentLength > maxBodySize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
 		}
-	}
 
-	w.WriteHeader(resp.StatusCode)
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "expected http.ResponseWriter to be an http.Flusher", http.StatusInternalServerError)
-		return
+		// chunked bodies are only checked while being streamed to the app
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
 	}
 
-	// Stream the response body to the client
-	buf := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			_, writeErr := w.Write(buf[:n])
-			if writeErr != nil {
-				return
-			}
-			flusher.Flush() // flush the buffer to the client
-		}
-		if err != nil {
-			if err != io.EOF {
-				http.Error(w, "Error reading response body", http.StatusInternalServerError)
-			}
-			break
-		}
-	}
+	me.handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
 func DenoExecutable() (string, error) {
@@ -425,6 +452,10 @@ func DenoExecutable() (string, error) {
 }
 
 func (me *Worker) TriggerCron(ctx context.Context, job app.CronJob) error {
+	if err := me.createDataDir(); err != nil {
+		return err
+	}
+
 	deno, err := DenoExecutable()
 	if err != nil {
 		return fmt.Errorf("could not find deno executable")
@@ -446,11 +477,18 @@ func (me *Worker) TriggerCron(ctx context.Context, job app.CronJob) error {
 	command := exec.CommandContext(ctx, deno, args...)
 	command.Dir = me.App.Dir()
 	command.Env = me.App.Env()
+	if err := me.isolate(command); err != nil {
+		return fmt.Errorf("could not sandbox command: %w", err)
+	}
 
-	return command.Run()
+	return me.run(command)
 }
 
 func (me *Worker) SendEmail(ctx context.Context, msg []byte) error {
+	if err := me.createDataDir(); err != nil {
+		return err
+	}
+
 	deno, err := DenoExecutable()
 	if err != nil {
 		return fmt.Errorf("could not find deno executable")
@@ -475,14 +513,73 @@ func (me *Worker) SendEmail(ctx context.Context, msg []byte) error {
 	command.Dir = me.App.Dir()
 
 	command.Env = me.App.Env()
+	if err := me.isolate(command); err != nil {
+		return fmt.Errorf("could not sandbox command: %w", err)
+	}
+
+	return me.run(command)
+}
+
+// isolate wraps a deno command in an os-level sandbox, if enabled for the app.
+func (me *Worker) isolate(command *exec.Cmd) error {
+	if !me.Sandbox {
+		return nil
+	}
+
+	baseDir, err := filepath.EvalSymlinks(me.App.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	readWrite := []string{filepath.Join(baseDir, "data")}
+	// releases link to the data dir shared by the app
+	if dataDir, err := filepath.EvalSymlinks(filepath.Join(me.App.Dir(), "data")); err == nil && !slices.Contains(readWrite, dataDir) {
+		readWrite = append(readWrite, dataDir)
+	}
+
+	if me.socketDir != "" {
+		readWrite = append(readWrite, me.socketDir)
+	}
+
+	return sandbox.Wrap(command, sandbox.Options{
+		RootDir:   me.App.RootDir,
+		App:       me.App.Name,
+		ReadOnly:  []string{baseDir, filepath.Dir(sandboxPath)},
+		ReadWrite: readWrite,
+	})
+}
+
+// run runs a deno command within the resource limits of the app.
+func (me *Worker) run(command *exec.Cmd) error {
+	limiter := newLimiter(me.App.Name, me.Limits, me.Logger)
+	defer limiter.release()
+
+	if limiter.err != nil && me.Logger != nil {
+		me.Logger.Warn("some resource limits are not enforced", "error", limiter.err)
+	}
+
+	if err := limiter.start(command); err != nil {
+		return err
+	}
+
+	err := command.Wait()
+	if limiter.oomKilled() {
+		return fmt.Errorf("killed for exceeding the memory limit of %dMiB", me.Limits.Memory)
+	}
 
-	return command.Run()
+	return err
 }
 
-func (me *Worker) Command(ctx context.Context, a []string) (*exec.Cmd, error) {
+// Command returns a deno command running the app, within its resource limits. As the caller manages
+// the process, it must call the returned func once the process exited, to drop the cgroup of the process.
+func (me *Worker) Command(ctx context.Context, a []string) (*exec.Cmd, func(), error) {
+	if err := me.createDataDir(); err != nil {
+		return nil, nil, err
+	}
+
 	deno, err := DenoExecutable()
 	if err != nil {
-		return nil, fmt.Errorf("could not find deno executable")
+		return nil, nil, fmt.Errorf("could not find deno executable")
 	}
 
 	payload := strings.Builder{}
@@ -493,27 +590,25 @@ func (me *Worker) Command(ctx context.Context, a []string) (*exec.Cmd, error) {
 		"method":     "run",
 		"args":       a,
 	}); err != nil {
-		return nil, fmt.Errorf("could not encode input: %w", err)
+		return nil, nil, fmt.Errorf("could not encode input: %w", err)
 	}
 
 	args := me.Args(payload.String())
 	command := exec.CommandContext(ctx, deno, args...)
 	command.Env = me.App.Env()
+	if err := me.isolate(command); err != nil {
+		return nil, nil, fmt.Errorf("could not sandbox command: %w", err)
+	}
 
-	return command, nil
-}
-
-// GetFreePort asks the kernel for a free open port that is ready to use.
-func GetFreePort() (int, error) {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	if err != nil {
-		return 0, err
+	limiter := newLimiter(me.App.Name, me.Limits, me.Logger)
+	if limiter.err != nil && me.Logger != nil {
+		me.Logger.Warn("some resource limits are not enforced", "error", limiter.err)
 	}
 
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return 0, err
+	if err := limiter.apply(command); err != nil {
+		limiter.release()
+		return nil, nil, fmt.Errorf("could not limit command: %w", err)
 	}
-	defer l.Close()
-	return l.Addr().(*net.TCPAddr).Port, nil
+
+	return command, limiter.release, nil
 }